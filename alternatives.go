@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/atotto/clipboard"
+	"github.com/getlantern/systray"
+	"github.com/sqweek/dialog"
+)
+
+// maxAlternatives is the number of alternative recognitions offered in the tray menu
+const maxAlternatives = 5
+
+// alternativeTitleLength limits how much of a hypothesis is shown in a menu item
+const alternativeTitleLength = 60
+
+var mAlternatives *systray.MenuItem
+var alternativeItems []*systray.MenuItem
+var alternativeTexts []string
+var alternativesMutex sync.Mutex
+
+// setupAlternativesMenu adds the "Alternatives" submenu. Its entries stay
+// hidden until an uncertain recognition produces alternatives.
+func setupAlternativesMenu() {
+	mAlternatives = systray.AddMenuItem("Alternatives", "Alternative recognitions of the last uncertain capture")
+	mAlternatives.Disable()
+	for i := 0; i < maxAlternatives; i++ {
+		item := mAlternatives.AddSubMenuItem("", "Copy this alternative to the clipboard")
+		item.Hide()
+		alternativeItems = append(alternativeItems, item)
+		go func(index int, item *systray.MenuItem) {
+			for range item.ClickedCh {
+				copyAlternative(index)
+			}
+		}(i, item)
+	}
+}
+
+// showAlternatives recognizes the image again with beam search and offers the
+// distinct hypotheses in the tray menu. It reports whether any were shown.
+func showAlternatives(ctx context.Context, imageBytes []byte, outputFmt string) bool {
+	results, err := engine.PredictNBestContext(ctx, imageBytes, outputFmt, maxAlternatives)
+	if err != nil {
+		log.Printf("Failed to compute alternative recognitions: %v", err)
+		return false
+	}
+	if len(results) < 2 {
+		log.Println("No distinct alternative recognitions found.")
+		return false
+	}
+
+	alternativesMutex.Lock()
+	alternativeTexts = alternativeTexts[:0]
+	var lines []string
+	for i, item := range alternativeItems {
+		if i >= len(results) {
+			item.Hide()
+			continue
+		}
+		result := results[i]
+		alternativeTexts = append(alternativeTexts, result.Text)
+		title := fmt.Sprintf("%s (%.0f%%)", truncateForMenu(result.LaTeX), result.Confidence*100)
+		item.SetTitle(title)
+		item.Show()
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, title))
+	}
+	alternativesMutex.Unlock()
+	mAlternatives.Enable()
+
+	message := "The recognition is uncertain. The best result was copied to the clipboard; possible alternatives:\n\n" +
+		strings.Join(lines, "\n") +
+		"\n\nChoose one from the tray menu under \"Alternatives\" to copy it instead."
+	go dialog.Message(message).Title("Review Recommended").Info()
+	return true
+}
+
+func copyAlternative(index int) {
+	alternativesMutex.Lock()
+	if index >= len(alternativeTexts) {
+		alternativesMutex.Unlock()
+		return
+	}
+	text := alternativeTexts[index]
+	alternativesMutex.Unlock()
+
+	if err := clipboard.WriteAll(text); err != nil {
+		log.Printf("Failed to copy alternative to clipboard: %v", err)
+		dialog.Message(fmt.Sprintf("Failed to copy to clipboard: %v", err)).Title("Clipboard Error").Error()
+		return
+	}
+	log.Printf("Alternative %d copied to clipboard.", index+1)
+}
+
+func truncateForMenu(s string) string {
+	runes := []rune(s)
+	if len(runes) <= alternativeTitleLength {
+		return s
+	}
+	return string(runes[:alternativeTitleLength-1]) + "…"
+}
+
+// truncateTail keeps the end of s, which is where a streaming recognition
+// changes, so the progress tooltip keeps moving on long formulas.
+func truncateTail(s string) string {
+	runes := []rune(s)
+	if len(runes) <= alternativeTitleLength {
+		return s
+	}
+	return "…" + string(runes[len(runes)-alternativeTitleLength+1:])
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"MathReX/model_controller"
+	"github.com/getlantern/systray"
+	"github.com/sqweek/dialog"
+)
+
+var mClearCache *systray.MenuItem
+
+// cacheConfig returns the result cache configuration chosen in the settings.
+// The disk cache lives next to the settings file.
+func cacheConfig() model_controller.CacheConfig {
+	cfg := model_controller.CacheConfig{Entries: currentSettings.ResultCacheEntries}
+	if currentSettings.DiskCache && settingsFilePath != "" {
+		cfg.Dir = filepath.Join(filepath.Dir(settingsFilePath), "cache")
+	}
+	return cfg
+}
+
+// setupCacheMenu adds the "Clear Cache" item, whose tooltip shows the cache
+// statistics.
+func setupCacheMenu() {
+	mClearCache = systray.AddMenuItem("Clear Cache", "Forget cached recognition results")
+	if currentSettings.ResultCacheEntries <= 0 {
+		mClearCache.Hide()
+	}
+	updateCacheMenu()
+	go func() {
+		for range mClearCache.ClickedCh {
+			log.Println("Clear Cache menu clicked")
+			clearCache()
+		}
+	}()
+}
+
+// updateCacheMenu refreshes the cache statistics shown in the tray menu.
+func updateCacheMenu() {
+	eng := readyEngine()
+	if mClearCache == nil || eng == nil {
+		return
+	}
+	stats := eng.CacheStats()
+	mClearCache.SetTooltip(fmt.Sprintf("Forget cached recognition results (%d in memory, %d on disk, %d hits, %d misses)",
+		stats.Entries, stats.DiskEntries, stats.Hits, stats.Misses))
+}
+
+func clearCache() {
+	eng := readyEngine()
+	if eng == nil {
+		return
+	}
+	stats := eng.CacheStats()
+	if err := eng.ClearCache(); err != nil {
+		log.Printf("Failed to clear result cache: %v", err)
+		dialog.Message("Failed to clear the result cache: %v", err).Title("Cache Error").Error()
+		return
+	}
+	log.Printf("Result cache cleared (%d in memory, %d on disk; %d hits, %d misses so far).",
+		stats.Entries, stats.DiskEntries, stats.Hits, stats.Misses)
+	updateCacheMenu()
+}
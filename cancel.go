@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+
+	"github.com/getlantern/systray"
+)
+
+var mCancelRecognition *systray.MenuItem
+
+// setupCancelMenu adds the "Cancel Recognition" item. It is only shown while
+// a recognition is queued or running.
+func setupCancelMenu() {
+	mCancelRecognition = systray.AddMenuItem("Cancel Recognition", "Stop the running recognition")
+	mCancelRecognition.Hide()
+	go func() {
+		for range mCancelRecognition.ClickedCh {
+			log.Println("Cancel Recognition menu clicked")
+			cancelRecognitions()
+		}
+	}()
+}
+
+// updateCancelMenu shows the cancel item while any recognition job is active.
+func updateCancelMenu(active int) {
+	if mCancelRecognition == nil {
+		return
+	}
+	if active > 0 {
+		mCancelRecognition.Show()
+	} else {
+		mCancelRecognition.Hide()
+	}
+}
+
+// cancelRecognitions cancels every queued and running recognition.
+func cancelRecognitions() {
+	if jobs == nil {
+		return
+	}
+	log.Printf("Cancelled %d recognition(s).", jobs.CancelAll())
+}
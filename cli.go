@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	onnxruntime "github.com/yalue/onnxruntime_go"
+)
+
+// CLI flags. When imageFlag is set MathReX recognizes that image, prints the
+// result to stdout and exits without starting the tray.
+var imageFlag string
+var streamFlag bool
+var formatFlag string
+
+func registerCLIFlags() {
+	flag.StringVar(&imageFlag, "image", "", "recognize this image, print the result and exit")
+	flag.BoolVar(&streamFlag, "stream", false, "with --image, print the LaTeX decoded so far to stderr after every token")
+	flag.StringVar(&formatFlag, "format", "", "with --image, output format: latex, mathml or omml (default: the outputFormat setting)")
+}
+
+// runCLI recognizes imageFlag and returns the process exit code.
+func runCLI() int {
+	loadSettings()
+
+	katexJSData, err := GetEmbeddedKaTeXJS()
+	if err != nil {
+		log.Printf("Warning: Failed to get KaTeX JS: %v", err)
+	}
+	mathml2ommlJSData, err := GetEmbeddedMathML2OMMLJS()
+	if err != nil {
+		log.Printf("Warning: Failed to get embedded mathml2omml.js: %v", err)
+	}
+	if err := initEngine(katexJSData, mathml2ommlJSData); err != nil {
+		fmt.Fprintf(os.Stderr, "MathReX: %v\n", err)
+		return 1
+	}
+	defer onnxruntime.DestroyEnvironment()
+	defer engine.Close()
+
+	imageBytes, err := os.ReadFile(imageFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "MathReX: %v\n", err)
+		return 1
+	}
+
+	outputFmt := formatFlag
+	if outputFmt == "" {
+		outputFmt = currentSettings.OutputFormat
+	}
+
+	ctx := context.Background()
+	if currentSettings.RecognitionTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(currentSettings.RecognitionTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	var onPartial func(latex string)
+	if streamFlag {
+		onPartial = func(latex string) {
+			fmt.Fprintln(os.Stderr, latex)
+		}
+	}
+	result, err := engine.PredictStream(ctx, imageBytes, outputFmt, onPartial)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "MathReX: %v\n", err)
+		return 1
+	}
+	fmt.Println(result.Text)
+	if result.Looped {
+		fmt.Fprintln(os.Stderr, "MathReX: warning: decoding stopped in a repetition loop; the result is probably incomplete")
+	}
+	return 0
+}
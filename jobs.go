@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// maxQueuedJobs bounds how many recognitions may wait for a free worker.
+const maxQueuedJobs = 16
+
+// errQueueFull is the error of a job submitted while maxQueuedJobs are waiting.
+var errQueueFull = errors.New("too many recognitions queued")
+
+// jobState is the lifecycle state of a recognition job.
+type jobState int
+
+const (
+	jobQueued jobState = iota
+	jobRunning
+	jobDone
+	jobFailed
+)
+
+func (s jobState) String() string {
+	switch s {
+	case jobQueued:
+		return "queued"
+	case jobRunning:
+		return "running"
+	case jobDone:
+		return "done"
+	case jobFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("jobState(%d)", int(s))
+	}
+}
+
+// recognitionJob is one unit of work submitted to the job queue.
+type recognitionJob struct {
+	ID   uint64
+	Name string
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	run     func(ctx context.Context) error
+	done    chan struct{}
+
+	mu    sync.Mutex
+	state jobState
+	err   error
+}
+
+// State returns the job's current state and, once it has failed, the error.
+func (j *recognitionJob) State() (jobState, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state, j.err
+}
+
+// Wait blocks until the job is done or failed and returns its error.
+func (j *recognitionJob) Wait() error {
+	<-j.done
+	_, err := j.State()
+	return err
+}
+
+func (j *recognitionJob) setState(state jobState, err error) {
+	j.mu.Lock()
+	j.state, j.err = state, err
+	j.mu.Unlock()
+	if err != nil {
+		log.Printf("Job %d (%s): %s: %v", j.ID, j.Name, state, err)
+	} else {
+		log.Printf("Job %d (%s): %s", j.ID, j.Name, state)
+	}
+}
+
+// jobQueue runs recognition jobs on a fixed number of workers. Each job runs
+// with its own context and a panic in one job only fails that job.
+type jobQueue struct {
+	mu       sync.Mutex
+	active   map[uint64]*recognitionJob // queued and running jobs
+	nextID   uint64
+	pending  chan *recognitionJob
+	ready    func(ctx context.Context) error // blocks until jobs can run
+	onChange func(active int)                // called whenever the number of active jobs changes
+}
+
+// newJobQueue starts a queue that runs at most concurrency jobs at once. If
+// ready is not nil, each job stays queued until ready returns; its timeout
+// starts afterwards.
+func newJobQueue(concurrency int, ready func(ctx context.Context) error, onChange func(active int)) *jobQueue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	q := &jobQueue{
+		active:   make(map[uint64]*recognitionJob),
+		pending:  make(chan *recognitionJob, maxQueuedJobs),
+		ready:    ready,
+		onChange: onChange,
+	}
+	for i := 0; i < concurrency; i++ {
+		go q.worker()
+	}
+	log.Printf("Job queue started with %d worker(s)", concurrency)
+	return q
+}
+
+// Submit queues run under name. The timeout, if positive, starts when the job
+// begins running. When the queue is full the job fails immediately.
+func (q *jobQueue) Submit(name string, timeout time.Duration, run func(ctx context.Context) error) *recognitionJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.mu.Lock()
+	q.nextID++
+	j := &recognitionJob{
+		ID:      q.nextID,
+		Name:    name,
+		ctx:     ctx,
+		cancel:  cancel,
+		timeout: timeout,
+		run:     run,
+		done:    make(chan struct{}),
+	}
+	q.mu.Unlock()
+
+	j.setState(jobQueued, nil)
+	q.track(j)
+	select {
+	case q.pending <- j:
+	default:
+		q.finish(j, jobFailed, errQueueFull)
+	}
+	return j
+}
+
+// CancelAll cancels every queued and running job and returns how many there were.
+func (q *jobQueue) CancelAll() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.active {
+		j.cancel()
+	}
+	return len(q.active)
+}
+
+func (q *jobQueue) worker() {
+	for j := range q.pending {
+		q.execute(j)
+	}
+}
+
+func (q *jobQueue) execute(j *recognitionJob) {
+	if q.ready != nil {
+		if err := q.ready(j.ctx); err != nil {
+			q.finish(j, jobFailed, err)
+			return
+		}
+	}
+	if err := j.ctx.Err(); err != nil {
+		q.finish(j, jobFailed, err)
+		return
+	}
+
+	ctx := j.ctx
+	if j.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.timeout)
+		defer cancel()
+	}
+
+	j.setState(jobRunning, nil)
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("PANIC in job %d (%s): %v", j.ID, j.Name, r)
+				log.Printf("Stack trace: %s", debug.Stack())
+				err = fmt.Errorf("recognition panicked: %v", r)
+			}
+		}()
+		return j.run(ctx)
+	}()
+
+	if err != nil {
+		q.finish(j, jobFailed, err)
+	} else {
+		q.finish(j, jobDone, nil)
+	}
+}
+
+func (q *jobQueue) track(j *recognitionJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active[j.ID] = j
+	q.notify()
+}
+
+func (q *jobQueue) finish(j *recognitionJob, state jobState, err error) {
+	j.setState(state, err)
+	j.cancel()
+	close(j.done)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.active, j.ID)
+	q.notify()
+}
+
+// notify reports the number of active jobs; q.mu must be held so that
+// notifications arrive in order.
+func (q *jobQueue) notify() {
+	if q.onChange != nil {
+		q.onChange(len(q.active))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"MathReX/model_controller"
+	"github.com/getlantern/systray"
+	"github.com/sqweek/dialog"
+)
+
+// modelState is the loading state of the recognition engine.
+type modelState int
+
+const (
+	modelLoading modelState = iota
+	modelReady
+	modelFailed
+)
+
+func (s modelState) String() string {
+	switch s {
+	case modelLoading:
+		return "loading"
+	case modelReady:
+		return "ready"
+	case modelFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("modelState(%d)", int(s))
+	}
+}
+
+// models tracks the background loading of the engine. loaded is closed once
+// loading has finished, successfully or not.
+var models = struct {
+	mu     sync.Mutex
+	state  modelState
+	err    error // why loading failed
+	loaded chan struct{}
+}{loaded: make(chan struct{})}
+
+var mModelStatus *systray.MenuItem
+
+// setupModelStatusMenu adds a disabled item that shows whether the models
+// are loading, ready or failed to load.
+func setupModelStatusMenu() {
+	mModelStatus = systray.AddMenuItem("", "")
+	mModelStatus.Disable()
+	updateModelStatus()
+}
+
+// loadModelsInBackground initializes the engine without blocking the tray.
+// Recognitions submitted meanwhile wait in the job queue. Once the models
+// are loaded a warm-up inference runs before they are reported ready.
+func loadModelsInBackground(katexJSData, mathml2ommlJSData []byte) {
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("PANIC while loading models: %v", r)
+				log.Printf("Stack trace: %s", debug.Stack())
+				err = fmt.Errorf("loading panicked: %v", r)
+			}
+			finishModelLoading(err)
+		}()
+
+		start := time.Now()
+		if err = initEngine(katexJSData, mathml2ommlJSData); err != nil {
+			return
+		}
+		log.Printf("Models loaded in %v. Warming up...", time.Since(start))
+		systray.SetTooltip("MathReX - Warming up...")
+
+		start = time.Now()
+		if warmErr := engine.WarmUp(context.Background()); warmErr != nil {
+			// The engine itself loaded, so recognition may still work.
+			log.Printf("Warning: Warm-up inference failed: %v", warmErr)
+		} else {
+			log.Printf("Warm-up inference finished in %v", time.Since(start))
+		}
+	}()
+}
+
+func finishModelLoading(err error) {
+	if err != nil && !errors.Is(err, model_controller.ErrModelsNotLoaded) && !errors.Is(err, model_controller.ErrTokenizerNotLoaded) {
+		// e.g. the ONNX runtime library is missing
+		err = fmt.Errorf("%w: %w", model_controller.ErrModelsNotLoaded, err)
+	}
+	models.mu.Lock()
+	if err != nil {
+		models.state, models.err = modelFailed, err
+	} else {
+		models.state = modelReady
+	}
+	models.mu.Unlock()
+	close(models.loaded)
+
+	if err != nil {
+		log.Printf("ERROR: Failed to load models: %v", err)
+		go dialog.Message("The recognition models could not be loaded:\n%v\n\nSee mathrex_debug.log for details.", err).Title("Model Loading Failed").Error()
+	} else {
+		log.Println("All core components initialized successfully.")
+	}
+	updateModelStatus()
+	updateCacheMenu()
+}
+
+// modelStatus returns the loading state and, if loading failed, the reason.
+func modelStatus() (modelState, error) {
+	models.mu.Lock()
+	defer models.mu.Unlock()
+	return models.state, models.err
+}
+
+// readyEngine returns the engine once it has loaded, or nil while it is
+// loading or if loading failed.
+func readyEngine() *model_controller.Engine {
+	if state, _ := modelStatus(); state != modelReady {
+		return nil
+	}
+	return engine
+}
+
+// waitForModels blocks until loading has finished or ctx is done. It only
+// fails with ctx's error; callers check readyEngine for the outcome.
+func waitForModels(ctx context.Context) error {
+	select {
+	case <-models.loaded:
+		return nil
+	default:
+	}
+	log.Println("Waiting for the models to finish loading...")
+	select {
+	case <-models.loaded:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// updateModelStatus shows the loading state in the tray tooltip and menu.
+func updateModelStatus() {
+	state, err := modelStatus()
+	var title, tooltip string
+	switch state {
+	case modelLoading:
+		title, tooltip = "Models: Loading...", "MathReX - Loading models..."
+	case modelReady:
+		title, tooltip = "Models: Ready", "MathReX - Screenshot to Math"
+	case modelFailed:
+		title, tooltip = "Models: Failed to Load", "MathReX - Models failed to load"
+	}
+	systray.SetTooltip(tooltip)
+	if mModelStatus == nil {
+		return
+	}
+	mModelStatus.SetTitle(title)
+	if err != nil {
+		mModelStatus.SetTooltip(err.Error())
+	} else {
+		mModelStatus.SetTooltip(tooltip)
+	}
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"MathReX/model_controller"
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"image/color"
 	"image/png"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
@@ -14,6 +19,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,12 +35,83 @@ import (
 var embeddedFS embed.FS
 
 type AppSettings struct {
-	OutputFormat    string `json:"outputFormat"`
-	CaptureShortcut string `json:"captureShortcut"`
+	OutputFormat    string  `json:"outputFormat"`
+	CaptureShortcut string  `json:"captureShortcut"`
+	NumBeams        int     `json:"numBeams"`
+	LengthPenalty   float64 `json:"lengthPenalty"`
+	EarlyStopping   bool    `json:"earlyStopping"`
+	// Recognitions below this confidence are flagged for manual review.
+	LowConfidenceThreshold float64 `json:"lowConfidenceThreshold"`
+	// Offer alternative recognitions in the tray when the best one is uncertain.
+	ShowAlternatives bool `json:"showAlternatives"`
+	// ModelDir points at an external model export to use instead of the
+	// embedded one. Empty means the embedded model.
+	ModelDir string `json:"modelDir"`
+	// RecognitionTimeoutSeconds aborts a recognition that runs longer than
+	// this. Zero disables the timeout.
+	RecognitionTimeoutSeconds int `json:"recognitionTimeoutSeconds"`
+	// MaxConcurrentJobs is how many recognitions may run at once; further
+	// ones wait in the queue.
+	MaxConcurrentJobs int `json:"maxConcurrentJobs"`
+	// SessionPoolSize is the number of encoder/decoder session pairs, i.e.
+	// how many recognitions can run inference in parallel.
+	SessionPoolSize int `json:"sessionPoolSize"`
+	// IntraOpThreads and InterOpThreads set the ONNX Runtime thread counts
+	// of each session. Zero keeps the runtime's defaults.
+	IntraOpThreads int `json:"intraOpThreads"`
+	InterOpThreads int `json:"interOpThreads"`
+	// GraphOptimizationLevel is one of "disable_all", "basic", "extended"
+	// or "all".
+	GraphOptimizationLevel string `json:"graphOptimizationLevel"`
+	// CPUMemArena and MemPattern toggle ONNX Runtime's memory arena and
+	// memory pattern optimizations.
+	CPUMemArena bool `json:"cpuMemArena"`
+	MemPattern  bool `json:"memPattern"`
+	// LoopRepeats stops decoding once a short run of tokens has repeated
+	// this many times at the end of the output, and flags the result as
+	// looped. Zero disables the check; unset keeps the model's
+	// loop_repeats (12 by default).
+	LoopRepeats *int `json:"loopRepeats,omitempty"`
+	// GrammarConstrained masks tokens that would produce unbalanced LaTeX
+	// during decoding.
+	GrammarConstrained bool `json:"grammarConstrained"`
+	// ResultCacheEntries is how many recognition results are kept in memory
+	// so that recognizing the same image again skips the models. Zero
+	// disables the cache.
+	ResultCacheEntries int `json:"resultCacheEntries"`
+	// DiskCache also keeps results in the cache directory next to the
+	// settings file, so they survive restarts.
+	DiskCache bool `json:"diskCache"`
+	// ResizeMode is "stretch" to scale captures to the model's input size
+	// like the model was trained, or "letterbox" to keep their aspect ratio
+	// and pad with the background color.
+	ResizeMode string `json:"resizeMode"`
+	// AlphaBackground is the "#rrggbb" color transparent images are
+	// composited onto before recognition.
+	AlphaBackground string `json:"alphaBackground"`
+	// AutoInvert inverts light-on-dark captures, Grayscale drops color and
+	// NormalizeBackground maps the estimated background color to white.
+	AutoInvert          bool `json:"autoInvert"`
+	Grayscale           bool `json:"grayscale"`
+	NormalizeBackground bool `json:"normalizeBackground"`
+	// Deskew straightens captures rotated by up to 10 degrees.
+	Deskew bool `json:"deskew"`
+	// TrimWhitespace crops captures to their ink before resizing and adds
+	// a margin of TrimMargin pixels of background on every side.
+	TrimWhitespace bool `json:"trimWhitespace"`
+	TrimMargin     int  `json:"trimMargin"`
 }
 
 var currentSettings AppSettings
+var engine *model_controller.Engine
 var settingsFilePath string
+var jobs *jobQueue
+
+// captureMutex keeps interactive screen captures from overlapping.
+var captureMutex sync.Mutex
+
+// modelDirFlag overrides the modelDir setting for this run.
+var modelDirFlag string
 var mCaptureShortcut *systray.MenuItem
 
 // Global state for shortcut setting
@@ -50,56 +127,120 @@ func GetEmbeddedMathML2OMMLJS() ([]byte, error) {
 	return embeddedFS.ReadFile("mathml2omml.js")
 }
 
-func extractAndGetPaths() (string, string, string, string, error) {
-	tempDir := os.TempDir()
-	libDir := filepath.Join(tempDir, "MathReX_lib")
-	modelDir := filepath.Join(tempDir, "MathReX_model")
+// initEngine initializes the ONNX runtime and loads the recognition engine
+// with the current settings.
+func initEngine(katexJSData, mathml2ommlJSData []byte) error {
+	log.Println("Locating ONNX runtime library...")
+	libPath, err := findSharedLibPath()
+	if err != nil {
+		log.Printf("On Windows, this is expected in debug mode - trying to continue...")
+		return fmt.Errorf("failed to locate ONNX runtime library: %w", err)
+	}
+	log.Printf("Setting ONNX runtime library path: %s", libPath)
+	onnxruntime.SetSharedLibraryPath(libPath)
 
-	if err := os.MkdirAll(libDir, 0755); err != nil {
-		return "", "", "", "", fmt.Errorf("failed to create lib temp dir: %w", err)
+	log.Println("Initializing ONNX runtime environment...")
+	if err := onnxruntime.InitializeEnvironment(); err != nil {
+		log.Printf("This is expected on Windows without proper ONNX runtime setup")
+		return fmt.Errorf("ONNX Init fail: %w", err)
+	}
+	log.Println("ONNX runtime initialized successfully")
+
+	log.Println("Initializing recognition engine...")
+	log.Printf("ONNX Runtime session settings: pool size %d, intra-op threads %d, inter-op threads %d (0 = default), graph optimization %s, CPU memory arena %v, memory pattern %v",
+		currentSettings.SessionPoolSize, currentSettings.IntraOpThreads, currentSettings.InterOpThreads,
+		currentSettings.GraphOptimizationLevel, currentSettings.CPUMemArena, currentSettings.MemPattern)
+	modelFS, modelDir, err := selectModelFS()
+	if err != nil {
+		return err
+	}
+	config := model_controller.EngineConfig{
+		ModelFS:       modelFS,
+		KaTeXJS:       katexJSData,
+		MathML2OMMLJS: mathml2ommlJSData,
+		PoolSize:      currentSettings.SessionPoolSize,
+		Session:       sessionOptions(),
+		Cache:         cacheConfig(),
+		Preprocess:    preprocessOptions(),
 	}
-	if err := os.MkdirAll(modelDir, 0755); err != nil {
-		return "", "", "", "", fmt.Errorf("failed to create model temp dir: %w", err)
+	engine, err = model_controller.New(config)
+	if err != nil && modelDir != "" {
+		// ValidateModelDir only checks the files exist and the configs
+		// parse; the sessions themselves can still fail to load.
+		log.Printf("Warning: Failed to load the model in %s: %v. Falling back to the embedded model.", modelDir, err)
+		go dialog.Message("The model in %s could not be loaded:\n%v\n\nFalling back to the embedded model.", modelDir, err).Title("Model Directory").Error()
+		if config.ModelFS, err = embeddedModelFS(); err != nil {
+			return err
+		}
+		engine, err = model_controller.New(config)
+	}
+	if err != nil {
+		return fmt.Errorf("Engine Init fail: %w", err)
+	}
+	status, err := engine.Status()
+	if err != nil {
+		return err
 	}
+	log.Printf("Recognition engine initialized successfully: %+v", status)
+	if err := engine.SetBeamSearch(currentSettings.NumBeams, currentSettings.LengthPenalty, currentSettings.EarlyStopping); err != nil {
+		return err
+	}
+	if currentSettings.LoopRepeats != nil {
+		if err := engine.SetLoopDetection(*currentSettings.LoopRepeats); err != nil {
+			return err
+		}
+	}
+	return engine.SetGrammarConstraint(currentSettings.GrammarConstrained)
+}
 
+// findSharedLibPath returns the path of the onnxruntime shared library
+// downloaded for this platform.
+func findSharedLibPath() (string, error) {
 	// Use runtime-downloaded ONNX library instead of embedded one
-	extractedLibPath := getDefaultSharedLibPath()
-	if extractedLibPath == "" {
-		return "", "", "", "", fmt.Errorf("could not determine library path for %s/%s", runtime.GOOS, runtime.GOARCH)
+	libPath := getDefaultSharedLibPath()
+	if libPath == "" {
+		return "", fmt.Errorf("could not determine library path for %s/%s", runtime.GOOS, runtime.GOARCH)
 	}
 
 	// Check if the library file exists
-	if _, err := os.Stat(extractedLibPath); os.IsNotExist(err) {
-		return "", "", "", "", fmt.Errorf("ONNX runtime library not found at %s. Please ensure download_onnxruntime.py has been run", extractedLibPath)
-	}
-	log.Printf("Using ONNX runtime library at: %s\n", extractedLibPath)
-
-	modelFiles := []string{"encoder_model.onnx", "decoder_model.onnx", "tokenizer.json"}
-	var extractedTokenizerPath, extractedEncoderPath, extractedDecoderPath string
-	for _, fName := range modelFiles {
-		embedPath := filepath.Join("model", fName)
-		data, err := embeddedFS.ReadFile(embedPath)
-		if err != nil {
-			return "", "", "", "", fmt.Errorf("failed to read embedded model file %s: %w", fName, err)
-		}
-		extractedPath := filepath.Join(modelDir, fName)
-		if err := os.WriteFile(extractedPath, data, 0644); err != nil {
-			return "", "", "", "", fmt.Errorf("failed to write model file %s: %w", fName, err)
-		}
-		log.Printf("Extracted model file to: %s\n", extractedPath)
-		switch fName {
-		case "tokenizer.json":
-			extractedTokenizerPath = extractedPath
-		case "encoder_model.onnx":
-			extractedEncoderPath = extractedPath
-		case "decoder_model.onnx":
-			extractedDecoderPath = extractedPath
-		}
+	if _, err := os.Stat(libPath); os.IsNotExist(err) {
+		return "", fmt.Errorf("ONNX runtime library not found at %s. Please ensure download_onnxruntime.py has been run", libPath)
 	}
-	if extractedTokenizerPath == "" || extractedEncoderPath == "" || extractedDecoderPath == "" {
-		return "", "", "", "", fmt.Errorf("one or more critical model files not found")
+	log.Printf("Using ONNX runtime library at: %s\n", libPath)
+	return libPath, nil
+}
+
+// selectModelFS returns the model to load: the directory named by the
+// --model-dir flag or the modelDir setting when it holds a valid export,
+// otherwise the embedded model. dir is empty when the embedded model is
+// used. Models are read straight into memory, so nothing is written to disk.
+func selectModelFS() (modelFS fs.FS, dir string, err error) {
+	dir, source := modelDirFlag, "--model-dir flag"
+	if dir == "" {
+		dir, source = currentSettings.ModelDir, "modelDir setting"
+	}
+	if dir == "" {
+		log.Println("Using the embedded model")
+		modelFS, err = embeddedModelFS()
+		return modelFS, "", err
+	}
+	if err := model_controller.ValidateModelDir(dir); err != nil {
+		log.Printf("Warning: Model directory %s from %s is not usable: %v. Falling back to the embedded model.", dir, source, err)
+		go dialog.Message("The model directory %s could not be used:\n%v\n\nFalling back to the embedded model.", dir, err).Title("Model Directory").Error()
+		modelFS, err = embeddedModelFS()
+		return modelFS, "", err
+	}
+	log.Printf("Using model directory %s from %s", dir, source)
+	return os.DirFS(dir), dir, nil
+}
+
+// embeddedModelFS returns the model embedded in the executable.
+func embeddedModelFS() (fs.FS, error) {
+	embedded, err := fs.Sub(embeddedFS, "model")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open embedded model: %w", err)
 	}
-	return extractedLibPath, extractedTokenizerPath, extractedEncoderPath, extractedDecoderPath, nil
+	return embedded, nil
 }
 
 func getDefaultSharedLibPath() string {
@@ -165,9 +306,30 @@ func getDefaultShortcut() string {
 	return "ctrl+shift+s"
 }
 
+func defaultSettings() AppSettings {
+	return AppSettings{
+		OutputFormat:              "mathml",
+		CaptureShortcut:           getDefaultShortcut(),
+		NumBeams:                  1,
+		LengthPenalty:             1.0,
+		LowConfidenceThreshold:    0.85,
+		RecognitionTimeoutSeconds: 60,
+		MaxConcurrentJobs:         1,
+		SessionPoolSize:           1,
+		GraphOptimizationLevel:    "all",
+		CPUMemArena:               true,
+		MemPattern:                true,
+		ResultCacheEntries:        256,
+		ResizeMode:                string(model_controller.ResizeStretch),
+		AlphaBackground:           "#ffffff",
+		AutoInvert:                true,
+		TrimMargin:                8,
+	}
+}
+
 func loadSettings() {
 	defaultShortcut := getDefaultShortcut()
-	currentSettings = AppSettings{OutputFormat: "mathml", CaptureShortcut: defaultShortcut}
+	currentSettings = defaultSettings()
 
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -195,7 +357,7 @@ func loadSettings() {
 	err = json.Unmarshal(data, &currentSettings)
 	if err != nil {
 		log.Printf("Warning: Could not parse settings file %s: %v. Using default settings.", settingsFilePath, err)
-		currentSettings = AppSettings{OutputFormat: "mathml", CaptureShortcut: defaultShortcut}
+		currentSettings = defaultSettings()
 	}
 	if currentSettings.OutputFormat != "latex" && currentSettings.OutputFormat != "mathml" {
 		if currentSettings.OutputFormat == "omml" {
@@ -208,9 +370,87 @@ func loadSettings() {
 	if currentSettings.CaptureShortcut == "" {
 		currentSettings.CaptureShortcut = defaultShortcut
 	}
+	if currentSettings.NumBeams < 1 {
+		log.Printf("Warning: Invalid numBeams %d loaded. Defaulting to greedy decoding.", currentSettings.NumBeams)
+		currentSettings.NumBeams = 1
+	}
+	if currentSettings.LoopRepeats != nil && *currentSettings.LoopRepeats < 0 {
+		log.Printf("Warning: Invalid loopRepeats %d loaded. Using the model's setting.", *currentSettings.LoopRepeats)
+		currentSettings.LoopRepeats = nil
+	}
+	if currentSettings.RecognitionTimeoutSeconds < 0 {
+		log.Printf("Warning: Invalid recognitionTimeoutSeconds %d loaded. Disabling the timeout.", currentSettings.RecognitionTimeoutSeconds)
+		currentSettings.RecognitionTimeoutSeconds = 0
+	}
+	if currentSettings.MaxConcurrentJobs < 1 {
+		log.Printf("Warning: Invalid maxConcurrentJobs %d loaded. Defaulting to 1.", currentSettings.MaxConcurrentJobs)
+		currentSettings.MaxConcurrentJobs = 1
+	}
+	if currentSettings.SessionPoolSize < 1 {
+		log.Printf("Warning: Invalid sessionPoolSize %d loaded. Defaulting to 1.", currentSettings.SessionPoolSize)
+		currentSettings.SessionPoolSize = 1
+	}
+	if err := sessionOptions().Validate(); err != nil {
+		log.Printf("Warning: Invalid ONNX Runtime session settings: %v. Using defaults.", err)
+		defaults := defaultSettings()
+		currentSettings.IntraOpThreads = defaults.IntraOpThreads
+		currentSettings.InterOpThreads = defaults.InterOpThreads
+		currentSettings.GraphOptimizationLevel = defaults.GraphOptimizationLevel
+	}
+	if _, err := parseHexColor(currentSettings.AlphaBackground); err != nil {
+		log.Printf("Warning: Invalid alphaBackground %q loaded: %v. Defaulting to white.", currentSettings.AlphaBackground, err)
+		currentSettings.AlphaBackground = defaultSettings().AlphaBackground
+	}
+	if err := preprocessOptions().Validate(); err != nil {
+		log.Printf("Warning: Invalid preprocessing settings: %v. Using defaults.", err)
+		defaults := defaultSettings()
+		currentSettings.ResizeMode = defaults.ResizeMode
+		currentSettings.TrimMargin = defaults.TrimMargin
+	}
 	log.Printf("Settings loaded: %+v", currentSettings)
 }
 
+// preprocessOptions returns the image preprocessing options chosen in the settings.
+func preprocessOptions() model_controller.PreprocessOptions {
+	background, err := parseHexColor(currentSettings.AlphaBackground)
+	if err != nil {
+		background = color.White
+	}
+	return model_controller.PreprocessOptions{
+		ResizeMode:          model_controller.ResizeMode(currentSettings.ResizeMode),
+		Background:          background,
+		AutoInvert:          currentSettings.AutoInvert,
+		Grayscale:           currentSettings.Grayscale,
+		NormalizeBackground: currentSettings.NormalizeBackground,
+		Deskew:              currentSettings.Deskew,
+		Trim:                currentSettings.TrimWhitespace,
+		TrimMargin:          currentSettings.TrimMargin,
+	}
+}
+
+// parseHexColor parses a "#rrggbb" color.
+func parseHexColor(s string) (color.Color, error) {
+	if len(s) != 7 || s[0] != '#' {
+		return nil, fmt.Errorf("want #rrggbb")
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("want #rrggbb: %w", err)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// sessionOptions returns the ONNX Runtime session options chosen in the settings.
+func sessionOptions() model_controller.SessionOptions {
+	return model_controller.SessionOptions{
+		IntraOpThreads:         currentSettings.IntraOpThreads,
+		InterOpThreads:         currentSettings.InterOpThreads,
+		GraphOptimizationLevel: currentSettings.GraphOptimizationLevel,
+		DisableCPUMemArena:     !currentSettings.CPUMemArena,
+		DisableMemPattern:      !currentSettings.MemPattern,
+	}
+}
+
 func saveSettings() {
 	if settingsFilePath == "" {
 		homeDir, _ := os.UserHomeDir()
@@ -234,13 +474,22 @@ func saveSettings() {
 }
 
 func main() {
-	// Set up logging to both console and file for debugging
+	flag.StringVar(&modelDirFlag, "model-dir", "", "load the model from this directory instead of the embedded one")
+	registerCLIFlags()
+	flag.Parse()
+
+	// Set up logging to both console and file for debugging. In CLI mode
+	// stdout carries the result, so the console log goes to stderr.
+	console := io.Writer(os.Stdout)
+	if imageFlag != "" {
+		console = os.Stderr
+	}
 	logFile, err := os.OpenFile("mathrex_debug.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		log.Printf("Warning: Could not create log file: %v", err)
 	} else {
 		defer logFile.Close()
-		log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+		log.SetOutput(io.MultiWriter(console, logFile))
 	}
 
 	log.Println("=== MathReX Starting ===")
@@ -259,9 +508,23 @@ func main() {
 		}
 	}()
 
+	if imageFlag != "" {
+		code := runCLI()
+		if logFile != nil {
+			logFile.Close()
+		}
+		os.Exit(code)
+	}
+
 	onExit := func() {
 		log.Println("MathReX onExit: Shutting down hotkey manager...")
 		ShutdownHotkeyManager()
+		// An engine still loading or warming up is left to the OS.
+		if eng := readyEngine(); eng != nil {
+			log.Println("MathReX onExit: Closing recognition engine...")
+			eng.Close()
+			onnxruntime.DestroyEnvironment()
+		}
 		log.Println("MathReX onExit: Systray cleanup.")
 		log.Println("MathReX application finished.")
 	}
@@ -288,6 +551,7 @@ func onReady() {
 	log.Println("Loading settings...")
 	loadSettings()
 	log.Println("Settings loaded successfully")
+	jobs = newJobQueue(currentSettings.MaxConcurrentJobs, waitForModels, updateCancelMenu)
 
 	// Initialize hotkey manager
 	log.Println("Initializing hotkey manager...")
@@ -299,48 +563,26 @@ func onReady() {
 		log.Println("Hotkey manager initialized successfully")
 	}
 
-	log.Println("Extracting embedded files...")
-	extractedLibPath, extractedTokenizerPath, extractedEncoderPath, extractedDecoderPath, err := extractAndGetPaths()
-
-	var tempModelDir string
-	var modelsInitialized bool = false
-
+	log.Println("Loading KaTeX...")
+	katexJSData, err := GetEmbeddedKaTeXJS()
 	if err != nil {
-		log.Printf("ERROR: Failed to extract embedded files: %v", err)
-		log.Printf("This usually means ONNX runtime library is missing")
-		log.Printf("On Windows, this is expected in debug mode - trying to continue...")
+		log.Printf("ERROR: Failed to get KaTeX JS: %v", err)
+		if runtime.GOOS != "windows" {
+			log.Fatalf("Failed to get embedded KaTeX JS: %v", err)
+		}
 	} else {
-		log.Printf("Files extracted successfully. Lib: %s", extractedLibPath)
-
-		tempModelDir = filepath.Dir(extractedTokenizerPath)
-		defer os.RemoveAll(filepath.Dir(extractedLibPath))
-		defer os.RemoveAll(tempModelDir)
-
-		log.Printf("Setting ONNX runtime library path: %s", extractedLibPath)
-		onnxruntime.SetSharedLibraryPath(extractedLibPath)
-
-		log.Println("Initializing ONNX runtime environment...")
-		if err := onnxruntime.InitializeEnvironment(); err != nil {
-			log.Printf("ERROR: ONNX Init fail: %v", err)
-			log.Printf("This is expected on Windows without proper ONNX runtime setup")
-		} else {
-			log.Println("ONNX runtime initialized successfully")
-
-			log.Println("Initializing tokenizer...")
-			if err := model_controller.InitTokenizer(extractedTokenizerPath); err != nil {
-				log.Printf("ERROR: Tokenizer Init fail: %v", err)
-			} else {
-				log.Println("Tokenizer initialized successfully")
+		log.Println("KaTeX loaded successfully")
+	}
 
-				log.Println("Initializing models...")
-				if err := model_controller.InitModels(extractedEncoderPath, extractedDecoderPath); err != nil {
-					log.Printf("ERROR: Models Init fail: %v", err)
-				} else {
-					log.Println("Models initialized successfully")
-					modelsInitialized = true
-				}
-			}
+	log.Println("Loading MathML2OMML...")
+	mathml2ommlJSData, err := GetEmbeddedMathML2OMMLJS()
+	if err != nil || len(mathml2ommlJSData) == 0 {
+		log.Printf("ERROR: Failed to get embedded mathml2omml.js: %v or data is empty", err)
+		if runtime.GOOS != "windows" {
+			log.Fatalf("Failed to get embedded mathml2omml.js: %v or data is empty", err)
 		}
+	} else {
+		log.Println("MathML2OMML loaded successfully")
 	}
 
 	// For Windows debugging, let's try to show what files are available
@@ -406,36 +648,6 @@ func onReady() {
 		log.Println("=== End Windows Debug ===")
 	}
 
-	log.Println("Initializing KaTeX...")
-	katexJSData, err := GetEmbeddedKaTeXJS()
-	if err != nil {
-		log.Printf("ERROR: Failed to get KaTeX JS: %v", err)
-		if runtime.GOOS != "windows" {
-			log.Fatalf("Failed to get embedded KaTeX JS: %v", err)
-		}
-	} else {
-		model_controller.InitKaTeX(katexJSData)
-		log.Println("KaTeX initialized successfully")
-	}
-
-	log.Println("Initializing MathML2OMML...")
-	mathml2ommlJSData, err := GetEmbeddedMathML2OMMLJS()
-	if err != nil || len(mathml2ommlJSData) == 0 {
-		log.Printf("ERROR: Failed to get embedded mathml2omml.js: %v or data is empty", err)
-		if runtime.GOOS != "windows" {
-			log.Fatalf("Failed to get embedded mathml2omml.js: %v or data is empty", err)
-		}
-	} else {
-		model_controller.InitMathML2OMMLJS(mathml2ommlJSData)
-		log.Println("MathML2OMML initialized successfully")
-	}
-
-	if modelsInitialized {
-		log.Println("All core components initialized successfully.")
-	} else {
-		log.Println("Core components partially initialized (debugging mode).")
-	}
-
 	// Set systray icon
 	log.Println("Setting up systray...")
 	iconData, err := embeddedFS.ReadFile("icon.png")
@@ -449,14 +661,18 @@ func onReady() {
 
 	log.Println("Setting systray title and tooltip...")
 	systray.SetTitle("MathReX")
-	systray.SetTooltip("MathReX - Screenshot to Math")
+	systray.SetTooltip("MathReX - Loading models...")
 	log.Println("Systray title and tooltip set")
 
 	log.Println("Adding menu items...")
+	setupModelStatusMenu()
+	log.Println("Added model status menu item")
 	mCapture := systray.AddMenuItem("Capture & Recognize", "Capture a screen region via menu")
 	log.Println("Added Capture menu item")
 	mFromFile := systray.AddMenuItem("Recognize from File...", "Select an image file")
 	log.Println("Added From File menu item")
+	setupCancelMenu()
+	log.Println("Added Cancel Recognition menu item")
 	systray.AddSeparator()
 	log.Println("Added separator")
 
@@ -466,6 +682,14 @@ func onReady() {
 	mFormatMathML := mOutputFormat.AddSubMenuItemCheckbox("MathML", "MathML", currentSettings.OutputFormat == "mathml")
 	log.Println("Added format submenu items")
 
+	mShowAlternatives := systray.AddMenuItemCheckbox("Show Alternatives When Uncertain", "Offer alternative recognitions for low-confidence results", currentSettings.ShowAlternatives)
+	setupAlternativesMenu()
+	log.Println("Added alternatives menu items")
+
+	mGrammar := systray.AddMenuItemCheckbox("Enforce Balanced LaTeX", "Prevent unbalanced braces and environments during recognition", currentSettings.GrammarConstrained)
+	setupCacheMenu()
+	log.Println("Added cache menu item")
+
 	systray.AddSeparator()
 	mCaptureShortcut = systray.AddMenuItem(fmt.Sprintf("Capture Shortcut: %s", currentSettings.CaptureShortcut), "Current capture shortcut")
 	mCaptureShortcut.Disable()
@@ -478,6 +702,9 @@ func onReady() {
 	mQuit := systray.AddMenuItem("Quit MathReX", "Exit the application")
 	log.Println("Added quit menu item")
 
+	log.Println("Loading models in the background...")
+	loadModelsInBackground(katexJSData, mathml2ommlJSData)
+
 	// Register the capture hotkey
 	log.Println("Registering capture hotkey...")
 	registerCaptureHotkey()
@@ -511,6 +738,31 @@ func onReady() {
 				currentSettings.OutputFormat = "mathml"
 				updateFormatCheckmarks(mFormatLatex, mFormatMathML)
 				saveSettings()
+			case <-mShowAlternatives.ClickedCh:
+				currentSettings.ShowAlternatives = !currentSettings.ShowAlternatives
+				log.Printf("Show alternatives toggled: %v", currentSettings.ShowAlternatives)
+				if currentSettings.ShowAlternatives {
+					mShowAlternatives.Check()
+				} else {
+					mShowAlternatives.Uncheck()
+				}
+				saveSettings()
+			case <-mGrammar.ClickedCh:
+				currentSettings.GrammarConstrained = !currentSettings.GrammarConstrained
+				log.Printf("Grammar-constrained decoding toggled: %v", currentSettings.GrammarConstrained)
+				if currentSettings.GrammarConstrained {
+					mGrammar.Check()
+				} else {
+					mGrammar.Uncheck()
+				}
+				if eng := readyEngine(); eng != nil {
+					go func(enabled bool) {
+						if err := eng.SetGrammarConstraint(enabled); err != nil {
+							log.Printf("Failed to change grammar-constrained decoding: %v", err)
+						}
+					}(currentSettings.GrammarConstrained)
+				}
+				saveSettings()
 			case <-mSetShortcut.ClickedCh:
 				log.Println("Set Shortcut menu clicked")
 				go handleChangeShortcutGUI()
@@ -576,9 +828,34 @@ func updateFormatCheckmarks(latexItem, mathmlItem *systray.MenuItem) {
 
 func handleCaptureAndRecognize() {
 	log.Println("Capture & Recognize triggered.")
-	tempImagePath := filepath.Join(os.TempDir(), "mathrex_capture.png")
-	defer os.Remove(tempImagePath)
+	// Each capture gets its own directory so overlapping captures never share a file.
+	tempDir, err := os.MkdirTemp("", "mathrex_capture-")
+	if err != nil {
+		log.Printf("Failed to create capture directory: %v", err)
+		dialog.Message(fmt.Sprintf("Failed to capture screenshot: %v", err)).Title("Error").Error()
+		return
+	}
+	tempImagePath := filepath.Join(tempDir, "capture.png")
 
+	// Only one interactive capture can be on screen at a time.
+	if !captureMutex.TryLock() {
+		log.Println("A screen capture is already in progress, ignoring.")
+		os.RemoveAll(tempDir)
+		return
+	}
+	captured := captureScreen(tempImagePath)
+	captureMutex.Unlock()
+	if captured && setupRequired(processImageFile(tempImagePath)) {
+		// The user was told where the capture is saved, so keep it.
+		log.Printf("Keeping capture %s for later use", tempImagePath)
+		return
+	}
+	os.RemoveAll(tempDir)
+}
+
+// captureScreen saves a screenshot to tempImagePath and reports whether one
+// was taken.
+func captureScreen(tempImagePath string) bool {
 	var cmd *exec.Cmd
 	var err error
 
@@ -617,25 +894,25 @@ func handleCaptureAndRecognize() {
 	} else {
 		log.Println("Unsupported OS for screenshot capture.")
 		dialog.Message("Screenshot capture is not supported on this OS.").Title("Error").Error()
-		return
+		return false
 	}
 
 	if err != nil {
 		if runtime.GOOS != "windows" {
 			if _, statErr := os.Stat(tempImagePath); os.IsNotExist(statErr) {
 				log.Println("Screenshot selection cancelled or no file created.")
-				return
+				return false
 			}
 		}
 		log.Printf("Failed to execute screenshot command: %v", err)
 		dialog.Message(fmt.Sprintf("Failed to capture screenshot: %v", err)).Title("Error").Error()
-		return
+		return false
 	}
 	if _, err := os.Stat(tempImagePath); os.IsNotExist(err) {
 		log.Println("Screenshot file not created (selection likely cancelled).")
-		return
+		return false
 	}
-	processImageFile(tempImagePath)
+	return true
 }
 
 func handleRecognizeFromFile() {
@@ -654,20 +931,40 @@ func handleRecognizeFromFile() {
 	processImageFile(filePath)
 }
 
-func processImageFile(imagePath string) {
+// processImageFile recognizes the image at imagePath and returns the
+// recognition's error, if any, once the user has been told about it.
+func processImageFile(imagePath string) error {
 	log.Printf("Processing image file: %s", imagePath)
 	imageBytes, err := ioutil.ReadFile(imagePath)
 	if err != nil {
 		log.Printf("Failed to read image file %s: %v", imagePath, err)
 		dialog.Message(fmt.Sprintf("Failed to read image file: %v", err)).Title("Error").Error()
-		return
+		return err
 	}
 	if len(imageBytes) == 0 {
 		log.Printf("Image file %s is empty.", imagePath)
 		dialog.Message(fmt.Sprintf("Image file is empty: %s", imagePath)).Title("Error").Error()
-		return
+		return fmt.Errorf("image file %s is empty", imagePath)
 	}
 
+	job := jobs.Submit(filepath.Base(imagePath), time.Duration(currentSettings.RecognitionTimeoutSeconds)*time.Second, func(ctx context.Context) error {
+		return recognizeImage(ctx, imagePath, imageBytes)
+	})
+	err = job.Wait()
+	if errors.Is(err, errQueueFull) {
+		dialog.Message("Too many recognitions are waiting. Please try again once they have finished.").Title("Busy").Error()
+	}
+	return err
+}
+
+// setupRequired reports whether err means the ONNX runtime still has to be
+// set up, in which case Windows users are offered the image path instead.
+func setupRequired(err error) bool {
+	return runtime.GOOS == "windows" && (errors.Is(err, model_controller.ErrModelsNotLoaded) || errors.Is(err, model_controller.ErrTokenizerNotLoaded))
+}
+
+// recognizeImage runs one recognition job and reports the result to the user.
+func recognizeImage(ctx context.Context, imagePath string, imageBytes []byte) error {
 	outputFmt := currentSettings.OutputFormat
 	if outputFmt == "omml" {
 		outputFmt = "mathml"
@@ -675,12 +972,33 @@ func processImageFile(imagePath string) {
 	}
 
 	log.Printf("Attempting to process image with format: %s", outputFmt)
-	resultText, _, err := model_controller.ProcessImagePrediction(imageBytes, outputFmt)
+	var result *model_controller.PredictionResult
+	var err error
+	if state, loadErr := modelStatus(); state != modelReady {
+		// loadErr wraps ErrModelsNotLoaded or ErrTokenizerNotLoaded
+		err = loadErr
+	} else {
+		// Show the LaTeX decoded so far in the tray tooltip
+		result, err = engine.PredictStream(ctx, imageBytes, outputFmt, func(latex string) {
+			systray.SetTooltip("MathReX - Recognizing: " + truncateTail(latex))
+		})
+		systray.SetTooltip("MathReX - Screenshot to Math")
+		updateCacheMenu()
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Println("Recognition cancelled.")
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Recognition timed out after %d seconds.", currentSettings.RecognitionTimeoutSeconds)
+		dialog.Message(fmt.Sprintf("Recognition timed out after %d seconds.", currentSettings.RecognitionTimeoutSeconds)).Title("Timeout").Error()
+		return err
+	}
 	if err != nil {
 		log.Printf("Failed to process image prediction: %v", err)
 
 		// Provide more helpful error message and alternative for Windows users
-		if runtime.GOOS == "windows" && strings.Contains(err.Error(), "not initialized") {
+		if setupRequired(err) {
 			errorMsg := "Image recognition is not available in this debug version.\n\n" +
 				"To enable full functionality, please run one of these setup scripts:\n" +
 				"• setup_windows_deps.bat (Windows batch file)\n" +
@@ -695,23 +1013,46 @@ func processImageFile(imagePath string) {
 				log.Printf("Copied image path to clipboard: %s", imagePath)
 				dialog.Message(fmt.Sprintf("Image saved to:\n%s\n\nPath copied to clipboard!", imagePath)).Title("Image Captured").Info()
 			}
-			return
+			return err
+		} else if errors.Is(err, model_controller.ErrImageDecode) {
+			dialog.Message("The image could not be read. Please use a PNG, JPEG, GIF, BMP or TIFF image.\n\n%v", err).Title("Unsupported Image").Error()
+			return err
 		} else {
 			errorMsg := fmt.Sprintf("Failed to process image: %v", err)
 			dialog.Message(errorMsg).Title("Error").Error()
-			return
+			return err
 		}
 	}
 
+	log.Printf("Recognized region of %s: %v, skew %.1f°", filepath.Base(imagePath), result.CropRect, result.SkewAngle)
+	resultText := result.Text
 	err = clipboard.WriteAll(resultText)
 	if err != nil {
 		log.Printf("Failed to copy result to clipboard: %v", err)
 		dialog.Message(fmt.Sprintf("Failed to copy to clipboard: %v\n\nResult was:\n%s", err, resultText)).Title("Clipboard Error").Error()
+		return err
+	} else if result.Looped {
+		log.Printf("Result (%s) copied to clipboard; decoding stopped in a repetition loop.", currentSettings.OutputFormat)
+		if currentSettings.ShowAlternatives && showAlternatives(ctx, imageBytes, outputFmt) {
+			return nil
+		}
+		reviewMessage := fmt.Sprintf("Recognition stopped because the output kept repeating itself.\nFormat: %s\n\nThe result copied to the clipboard is probably incomplete. Please review it before use.",
+			currentSettings.OutputFormat)
+		go dialog.Message(reviewMessage).Title("Review Recommended").Info()
+	} else if result.Confidence < currentSettings.LowConfidenceThreshold {
+		log.Printf("Result (%s) copied to clipboard with low confidence %.3f.", currentSettings.OutputFormat, result.Confidence)
+		if currentSettings.ShowAlternatives && showAlternatives(ctx, imageBytes, outputFmt) {
+			return nil
+		}
+		reviewMessage := fmt.Sprintf("Recognition finished with low confidence (%.0f%%).\nFormat: %s\n\nLeast certain part: %s\n\nResult copied to clipboard. Please review it before use.",
+			result.Confidence*100, currentSettings.OutputFormat, result.LowestConfidenceSpan.Text)
+		go dialog.Message(reviewMessage).Title("Review Recommended").Info()
 	} else {
 		log.Printf("Result (%s) copied to clipboard.", currentSettings.OutputFormat)
-		successMessage := fmt.Sprintf("Recognition successful!\nFormat: %s\n\nResult copied to clipboard.", currentSettings.OutputFormat)
+		successMessage := fmt.Sprintf("Recognition successful!\nFormat: %s\nConfidence: %.0f%%\n\nResult copied to clipboard.", currentSettings.OutputFormat, result.Confidence*100)
 		go dialog.Message(successMessage).Title("Success").Info()
 	}
+	return nil
 }
 
 func handleChangeShortcutGUI() {
@@ -0,0 +1,229 @@
+package model_controller
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// beamHypothesis 表示束搜索中的一条候选序列
+type beamHypothesis struct {
+	ids      []int64
+	logProbs []float32   // 每个 token 在原始分布下的对数概率，与 ids 对齐
+	score    float64     // 累积对数概率
+	past     *kvCache    // 仅在 KV cache 模式下使用
+	looped   bool        // 因检测到重复循环而结束
+	grammar  *latexState // 启用 LaTeX 结构约束时的扫描状态
+}
+
+// normalizedScore 返回经过长度惩罚后的得分，与 transformers 的 BeamHypotheses 一致
+func (h beamHypothesis) normalizedScore(lengthPenalty float64) float64 {
+	return h.score / math.Pow(float64(len(h.ids)), lengthPenalty)
+}
+
+// generation 将假设转换为 Generation
+func (h beamHypothesis) generation(lengthPenalty float64) *Generation {
+	return &Generation{
+		Tokens:   int64ToUint32Slice(h.ids),
+		LogProbs: h.logProbs,
+		Score:    h.normalizedScore(lengthPenalty),
+		Looped:   h.looped,
+	}
+}
+
+// beamCandidate 表示某条 beam 扩展一个 token 后的候选
+type beamCandidate struct {
+	beam    int
+	token   int64
+	logProb float32 // 原始分布下的对数概率
+	score   float64 // 约束后分布下的累积对数概率
+}
+
+// beamSearch 执行束搜索，返回按长度惩罚后得分从高到低排序的完成假设（最多 numBeams 个）。
+// onStep 不为 nil 时，每一步以当前得分最高的未完成序列调用。
+func (d *Decoder) beamSearch(ctx context.Context, encoderOut *EncoderOutput, numBeams int, onStep StepFunc) ([]beamHypothesis, error) {
+	g, err := d.newGeneration(encoderOut)
+	if err != nil {
+		return nil, err
+	}
+	defer g.Destroy()
+
+	lengthPenalty := d.config.LengthPenalty
+	beams := []beamHypothesis{{ids: []int64{d.config.DecoderStartTokenID}, logProbs: []float32{0}}}
+	if d.grammar != nil {
+		beams[0].grammar = newLatexState()
+	}
+	var finished []beamHypothesis
+	defer func() {
+		for _, beam := range beams {
+			beam.past.release()
+		}
+	}()
+
+	for curLen := 1; curLen <= d.config.MaxLength; curLen++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var candidates []beamCandidate
+		stepPast := make([]*kvCache, len(beams))
+		for bi, beam := range beams {
+			logits, next, err := g.step(beam.ids, beam.past)
+			if err != nil {
+				for _, c := range stepPast {
+					c.release()
+				}
+				return nil, err
+			}
+			stepPast[bi] = next
+			rawLogProbs := logSoftmax(logits) // 置信度使用原始分布
+			d.processLogits(logits, beam.ids)
+			if beam.grammar != nil {
+				d.grammar.mask(logits, beam.grammar, d.config.EosTokenID)
+			}
+			logProbs := logSoftmax(logits)
+
+			// 每条 beam 取 2*numBeams 个候选，保证遇到 EOS 时仍有足够的未完成序列
+			for _, tok := range topK(logProbs, 2*numBeams) {
+				if math.IsInf(float64(logProbs[tok]), -1) {
+					continue // 被屏蔽的 token
+				}
+				candidates = append(candidates, beamCandidate{
+					beam:    bi,
+					token:   int64(tok),
+					logProb: rawLogProbs[tok],
+					score:   beam.score + float64(logProbs[tok]),
+				})
+			}
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].score > candidates[j].score
+		})
+
+		next := make([]beamHypothesis, 0, numBeams)
+		for rank, c := range candidates {
+			parent := beams[c.beam]
+			ids := make([]int64, len(parent.ids), len(parent.ids)+1)
+			copy(ids, parent.ids)
+			ids = append(ids, c.token)
+			logProbs := make([]float32, len(parent.logProbs), len(parent.logProbs)+1)
+			copy(logProbs, parent.logProbs)
+			logProbs = append(logProbs, c.logProb)
+
+			looped := detectLoop(ids, d.config.LoopRepeats)
+			if c.token == d.config.EosTokenID || looped {
+				// 只接受排名在前 numBeams 的 EOS 候选；陷入循环的序列同样不再扩展
+				if rank < numBeams {
+					finished = addFinishedHypothesis(finished, beamHypothesis{ids: ids, logProbs: logProbs, score: c.score, looped: looped}, numBeams, lengthPenalty)
+				}
+				continue
+			}
+			hyp := beamHypothesis{ids: ids, logProbs: logProbs, score: c.score, past: stepPast[c.beam].retain()}
+			if parent.grammar != nil {
+				hyp.grammar = d.grammar.advance(parent.grammar, c.token)
+			}
+			next = append(next, hyp)
+			if len(next) == numBeams {
+				break
+			}
+		}
+		for i, beam := range beams {
+			beam.past.release()
+			stepPast[i].release()
+		}
+		beams = next
+		if onStep != nil && len(beams) > 0 {
+			onStep(int64ToUint32Slice(beams[0].ids))
+		}
+
+		if len(beams) == 0 || beamSearchDone(finished, beams, numBeams, curLen+1, lengthPenalty, d.config.EarlyStopping) {
+			break
+		}
+	}
+
+	// 达到最大长度仍未结束的序列也作为候选
+	if len(finished) < numBeams {
+		for _, beam := range beams {
+			finished = addFinishedHypothesis(finished, beamHypothesis{ids: beam.ids, logProbs: beam.logProbs, score: beam.score}, numBeams, lengthPenalty)
+		}
+	}
+
+	sort.SliceStable(finished, func(i, j int) bool {
+		return finished[i].normalizedScore(lengthPenalty) > finished[j].normalizedScore(lengthPenalty)
+	})
+	return finished, nil
+}
+
+// addFinishedHypothesis 加入一条完成假设，超过 numBeams 时淘汰得分最低的一条
+func addFinishedHypothesis(finished []beamHypothesis, hyp beamHypothesis, numBeams int, lengthPenalty float64) []beamHypothesis {
+	finished = append(finished, hyp)
+	if len(finished) <= numBeams {
+		return finished
+	}
+	worst := 0
+	for i := 1; i < len(finished); i++ {
+		if finished[i].normalizedScore(lengthPenalty) < finished[worst].normalizedScore(lengthPenalty) {
+			worst = i
+		}
+	}
+	return append(finished[:worst], finished[worst+1:]...)
+}
+
+// beamSearchDone 判断是否可以提前结束搜索
+func beamSearchDone(finished, beams []beamHypothesis, numBeams, curLen int, lengthPenalty float64, earlyStopping bool) bool {
+	if len(finished) < numBeams {
+		return false
+	}
+	if earlyStopping {
+		return true
+	}
+	// 当前最好的未完成序列已无法超过最差的完成假设
+	worst := math.Inf(1)
+	for _, h := range finished {
+		worst = math.Min(worst, h.normalizedScore(lengthPenalty))
+	}
+	best := beams[0].score / math.Pow(float64(curLen), lengthPenalty)
+	return best < worst
+}
+
+// logSoftmax 计算数值稳定的 log-softmax
+func logSoftmax(logits []float32) []float32 {
+	maxLogit := logits[0]
+	for _, v := range logits[1:] {
+		if v > maxLogit {
+			maxLogit = v
+		}
+	}
+	out := make([]float32, len(logits))
+	if math.IsInf(float64(maxLogit), -1) {
+		// 所有候选都被屏蔽时 v-maxLogit 为 NaN，直接全部返回 -Inf
+		copy(out, logits)
+		return out
+	}
+	var sum float64
+	for _, v := range logits {
+		sum += math.Exp(float64(v - maxLogit))
+	}
+	logSum := float32(math.Log(sum))
+
+	for i, v := range logits {
+		out[i] = v - maxLogit - logSum
+	}
+	return out
+}
+
+// topK 返回值最大的 k 个下标（从大到小）
+func topK(values []float32, k int) []int {
+	if k > len(values) {
+		k = len(values)
+	}
+	idx := make([]int, len(values))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return values[idx[i]] > values[idx[j]]
+	})
+	return idx[:k]
+}
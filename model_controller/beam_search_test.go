@@ -0,0 +1,126 @@
+package model_controller
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	inf := float32(math.Inf(-1))
+	tests := []struct {
+		name   string
+		values []float32
+		k      int
+		want   []int
+	}{
+		{"top two", []float32{0.1, 0.5, 0.3, 0.4}, 2, []int{1, 3}},
+		{"k larger than len", []float32{0.1, 0.5}, 5, []int{1, 0}},
+		{"k zero", []float32{0.1, 0.5}, 0, []int{}},
+		{"ties keep index order", []float32{0.2, 0.7, 0.2, 0.7}, 3, []int{1, 3, 0}},
+		{"-Inf sorted last", []float32{inf, -3, inf, -1}, 4, []int{3, 1, 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := topK(tt.values, tt.k); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topK(%v, %d) = %v, want %v", tt.values, tt.k, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogSoftmax(t *testing.T) {
+	inf := math.Inf(-1)
+	tests := []struct {
+		name   string
+		logits []float32
+		want   []float64
+	}{
+		{"uniform", []float32{1, 1, 1, 1}, []float64{math.Log(0.25), math.Log(0.25), math.Log(0.25), math.Log(0.25)}},
+		{"large logits do not overflow", []float32{1000, 1000}, []float64{math.Log(0.5), math.Log(0.5)}},
+		{"masked logits stay -Inf", []float32{float32(inf), 2, float32(inf), 2}, []float64{inf, math.Log(0.5), inf, math.Log(0.5)}},
+		{"single logit", []float32{-7}, []float64{0}},
+		{"all masked", []float32{float32(inf), float32(inf)}, []float64{inf, inf}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := logSoftmax(tt.logits)
+			for i, want := range tt.want {
+				v := float64(got[i])
+				if math.IsInf(want, -1) {
+					if !math.IsInf(v, -1) {
+						t.Errorf("logSoftmax(%v)[%d] = %v, want -Inf", tt.logits, i, v)
+					}
+				} else if math.IsNaN(v) || math.Abs(v-want) > 1e-5 {
+					t.Errorf("logSoftmax(%v)[%d] = %v, want %v", tt.logits, i, v, want)
+				}
+			}
+		})
+	}
+}
+
+// hyp 创建长度为 n、累积对数概率为 score 的假设
+func hyp(n int, score float64) beamHypothesis {
+	return beamHypothesis{ids: make([]int64, n), score: score}
+}
+
+func TestAddFinishedHypothesis(t *testing.T) {
+	tests := []struct {
+		name          string
+		finished      []beamHypothesis
+		add           beamHypothesis
+		numBeams      int
+		lengthPenalty float64
+		want          []float64 // 剩余假设的 score，保持加入顺序
+	}{
+		{"below capacity", []beamHypothesis{hyp(3, -1)}, hyp(3, -2), 2, 1, []float64{-1, -2}},
+		{"new hypothesis is the worst", []beamHypothesis{hyp(3, -1), hyp(3, -2)}, hyp(3, -3), 2, 1, []float64{-1, -2}},
+		{"evicts the worst existing one", []beamHypothesis{hyp(3, -1), hyp(3, -3)}, hyp(3, -2), 2, 1, []float64{-1, -2}},
+		// 长度惩罚后 -2/2 = -1 比 -3/4 = -0.75 差
+		{"length penalty decides", []beamHypothesis{hyp(2, -2), hyp(4, -3)}, hyp(4, -2.8), 2, 1, []float64{-3, -2.8}},
+		// 不做长度惩罚时短序列的 -2 更好
+		{"no length penalty", []beamHypothesis{hyp(2, -2), hyp(4, -3)}, hyp(4, -2.8), 2, 0, []float64{-2, -2.8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addFinishedHypothesis(append([]beamHypothesis(nil), tt.finished...), tt.add, tt.numBeams, tt.lengthPenalty)
+			scores := make([]float64, len(got))
+			for i, h := range got {
+				scores[i] = h.score
+			}
+			if !reflect.DeepEqual(scores, tt.want) {
+				t.Errorf("scores = %v, want %v", scores, tt.want)
+			}
+		})
+	}
+}
+
+func TestBeamSearchDone(t *testing.T) {
+	finished := []beamHypothesis{hyp(4, -2), hyp(4, -4)} // 长度惩罚 1 时最差为 -1
+	tests := []struct {
+		name          string
+		finished      []beamHypothesis
+		best          float64 // 最好的未完成序列的累积对数概率
+		curLen        int
+		lengthPenalty float64
+		earlyStopping bool
+		want          bool
+	}{
+		{"not enough finished", finished[:1], -100, 4, 1, true, false},
+		{"early stopping", finished, 0, 4, 1, true, true},
+		{"best beam can still win", finished, -3, 4, 1, false, false},
+		{"best beam cannot win", finished, -5, 4, 1, false, true},
+		// 更长的序列得分被长度惩罚除得更小：-5/10 = -0.5 仍可能超过 -1
+		{"longer beam can still win", finished, -5, 10, 1, false, false},
+		// lengthPenalty 为 0 时直接比较累积对数概率：-5 < -4
+		{"no length penalty", finished, -5, 10, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			beams := []beamHypothesis{hyp(tt.curLen, tt.best)}
+			if got := beamSearchDone(tt.finished, beams, 2, tt.curLen, tt.lengthPenalty, tt.earlyStopping); got != tt.want {
+				t.Errorf("beamSearchDone = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
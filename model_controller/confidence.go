@@ -0,0 +1,56 @@
+package model_controller
+
+import "math"
+
+// lowConfidenceWindow 是查找最低置信度片段时使用的 token 窗口大小
+const lowConfidenceWindow = 3
+
+// ConfidenceSpan 描述识别结果中置信度最低的一段 token
+type ConfidenceSpan struct {
+	Start      int     // 在 Tokens 中的起始下标（包含）
+	End        int     // 在 Tokens 中的结束下标（不包含）
+	Text       string  // 该片段解码后的文本
+	Confidence float64 // 片段内 token 概率的几何平均值
+}
+
+// sequenceConfidence 返回生成 token（不含起始 token，含 EOS）概率的几何平均值，范围 [0, 1]
+func sequenceConfidence(logProbs []float32) float64 {
+	if len(logProbs) <= 1 {
+		return 0
+	}
+	var sum float64
+	for _, lp := range logProbs[1:] {
+		sum += float64(lp)
+	}
+	return math.Exp(sum / float64(len(logProbs)-1))
+}
+
+// lowestConfidenceSpan 在内容 token（不含起始 token 与 EOS）中查找平均对数概率最低的窗口，
+// 没有内容 token 时返回 ok=false
+func lowestConfidenceSpan(tokens []uint32, logProbs []float32, eosTokenID uint32) (start, end int, confidence float64, ok bool) {
+	contentEnd := len(tokens)
+	if contentEnd > 1 && tokens[contentEnd-1] == eosTokenID {
+		contentEnd--
+	}
+	if contentEnd <= 1 {
+		return 0, 0, 0, false
+	}
+
+	window := lowConfidenceWindow
+	if contentEnd-1 < window {
+		window = contentEnd - 1
+	}
+
+	best := math.Inf(1)
+	for i := 1; i+window <= contentEnd; i++ {
+		var sum float64
+		for _, lp := range logProbs[i : i+window] {
+			sum += float64(lp)
+		}
+		if mean := sum / float64(window); mean < best {
+			best = mean
+			start, end = i, i+window
+		}
+	}
+	return start, end, math.Exp(best), true
+}
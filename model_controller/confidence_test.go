@@ -0,0 +1,65 @@
+package model_controller
+
+import (
+	"math"
+	"testing"
+)
+
+// lp 返回概率 p 的对数概率
+func lp(p float64) float32 {
+	return float32(math.Log(p))
+}
+
+func TestSequenceConfidence(t *testing.T) {
+	tests := []struct {
+		name     string
+		logProbs []float32
+		want     float64
+	}{
+		{"empty", nil, 0},
+		{"start token only", []float32{0}, 0},
+		{"start and EOS", []float32{0, lp(0.5)}, 0.5},
+		// 起始 token 不参与平均：sqrt(0.5 * 0.125) = 0.25
+		{"geometric mean", []float32{0, lp(0.5), lp(0.125)}, 0.25},
+		{"certain", []float32{0, 0, 0}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sequenceConfidence(tt.logProbs); math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("sequenceConfidence(%v) = %v, want %v", tt.logProbs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLowestConfidenceSpan(t *testing.T) {
+	const eos = 2
+	tests := []struct {
+		name       string
+		tokens     []uint32
+		logProbs   []float32
+		start, end int
+		confidence float64
+		ok         bool
+	}{
+		{"empty", nil, nil, 0, 0, 0, false},
+		{"start token only", []uint32{0}, []float32{0}, 0, 0, 0, false},
+		{"start and EOS only", []uint32{0, eos}, []float32{0, lp(0.1)}, 0, 0, 0, false},
+		// 内容 token 少于窗口大小时整个内容作为一个片段，EOS 不计入
+		{"fewer than window", []uint32{0, 5, 6, eos}, []float32{0, lp(0.5), lp(0.125), lp(0.01)}, 1, 3, 0.25, true},
+		{"single content token", []uint32{0, 5, eos}, []float32{0, lp(0.4), lp(0.9)}, 1, 2, 0.4, true},
+		{"lowest window", []uint32{0, 5, 6, 7, 8, 9, eos},
+			[]float32{0, lp(0.9), lp(0.9), lp(0.1), lp(0.1), lp(0.1), lp(0.01)}, 3, 6, 0.1, true},
+		// 没有 EOS（达到最大长度或被取消）时最后一个 token 也是内容
+		{"no EOS", []uint32{0, 5, 6, 7, 8}, []float32{0, lp(0.9), lp(0.2), lp(0.2), lp(0.2)}, 2, 5, 0.2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, confidence, ok := lowestConfidenceSpan(tt.tokens, tt.logProbs, eos)
+			if ok != tt.ok || start != tt.start || end != tt.end || math.Abs(confidence-tt.confidence) > 1e-5 {
+				t.Errorf("lowestConfidenceSpan = (%d, %d, %v, %v), want (%d, %d, %v, %v)",
+					start, end, confidence, ok, tt.start, tt.end, tt.confidence, tt.ok)
+			}
+		})
+	}
+}
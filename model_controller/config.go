@@ -0,0 +1,159 @@
+package model_controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// decoderSection 是 config.json 中 decoder 部分用到的字段，缺失的字段为 nil
+type decoderSection struct {
+	BosTokenID            *int64   `json:"bos_token_id"`
+	EosTokenID            *int64   `json:"eos_token_id"`
+	DecoderStartTokenID   *int64   `json:"decoder_start_token_id"`
+	VocabSize             *int     `json:"vocab_size"`
+	MaxPositionEmbeddings *int     `json:"max_position_embeddings"`
+	NumBeams              *int     `json:"num_beams"`
+	LengthPenalty         *float64 `json:"length_penalty"`
+	EarlyStopping         *bool    `json:"early_stopping"`
+	NoRepeatNgramSize     *int     `json:"no_repeat_ngram_size"`
+	RepetitionPenalty     *float64 `json:"repetition_penalty"`
+	LoopRepeats           *int     `json:"loop_repeats"` // MathReX 扩展，transformers 中没有对应字段
+}
+
+// modelConfig 对应 VisionEncoderDecoder 导出的 config.json
+type modelConfig struct {
+	DecoderStartTokenID *int64         `json:"decoder_start_token_id"`
+	EosTokenID          *int64         `json:"eos_token_id"`
+	Decoder             decoderSection `json:"decoder"`
+}
+
+// generationConfig 对应 generation_config.json
+type generationConfig struct {
+	BosTokenID          *int64   `json:"bos_token_id"`
+	EosTokenID          *int64   `json:"eos_token_id"`
+	DecoderStartTokenID *int64   `json:"decoder_start_token_id"`
+	MaxNewTokens        *int     `json:"max_new_tokens"`
+	MaxLength           *int     `json:"max_length"`
+	NumBeams            *int     `json:"num_beams"`
+	LengthPenalty       *float64 `json:"length_penalty"`
+	EarlyStopping       *bool    `json:"early_stopping"`
+	NoRepeatNgramSize   *int     `json:"no_repeat_ngram_size"`
+	RepetitionPenalty   *float64 `json:"repetition_penalty"`
+	LoopRepeats         *int     `json:"loop_repeats"`
+}
+
+// DefaultDecoderConfig 返回 pix2text-mfr 模型的默认解码配置
+func DefaultDecoderConfig() *DecoderConfig {
+	return &DecoderConfig{
+		BosTokenID:          1,
+		EosTokenID:          2,
+		MaxLength:           512,
+		VocabSize:           1200,
+		DecoderStartTokenID: 2,
+		NumBeams:            1,
+		LengthPenalty:       1.0,
+		EarlyStopping:       false,
+		NoRepeatNgramSize:   0,
+		RepetitionPenalty:   1.0,
+		LoopRepeats:         12,
+	}
+}
+
+// LoadDecoderConfig 从模型目录中的 config.json 与 generation_config.json 读取解码配置。
+// generation_config.json 的设置优先；不存在的文件会被跳过，缺失的字段保留默认值。
+// config.json 中 decoder.max_length 是 transformers 的默认值（20），不作为生成长度使用。
+func LoadDecoderConfig(fsys fs.FS) (*DecoderConfig, error) {
+	config := DefaultDecoderConfig()
+
+	var mc modelConfig
+	if ok, err := readJSONFile(fsys, ConfigFile, &mc); err != nil {
+		return nil, err
+	} else if ok {
+		dec := mc.Decoder
+		setInt64(&config.BosTokenID, dec.BosTokenID)
+		setInt64(&config.EosTokenID, dec.EosTokenID)
+		setInt64(&config.EosTokenID, mc.EosTokenID)
+		setInt64(&config.DecoderStartTokenID, dec.DecoderStartTokenID)
+		setInt64(&config.DecoderStartTokenID, mc.DecoderStartTokenID)
+		setInt(&config.VocabSize, dec.VocabSize)
+		setInt(&config.MaxLength, dec.MaxPositionEmbeddings)
+		setInt(&config.NumBeams, dec.NumBeams)
+		setFloat64(&config.LengthPenalty, dec.LengthPenalty)
+		setBool(&config.EarlyStopping, dec.EarlyStopping)
+		setInt(&config.NoRepeatNgramSize, dec.NoRepeatNgramSize)
+		setFloat64(&config.RepetitionPenalty, dec.RepetitionPenalty)
+		setInt(&config.LoopRepeats, dec.LoopRepeats)
+	}
+
+	var gc generationConfig
+	if ok, err := readJSONFile(fsys, GenerationConfigFile, &gc); err != nil {
+		return nil, err
+	} else if ok {
+		setInt64(&config.BosTokenID, gc.BosTokenID)
+		setInt64(&config.EosTokenID, gc.EosTokenID)
+		setInt64(&config.DecoderStartTokenID, gc.DecoderStartTokenID)
+		setInt(&config.MaxLength, gc.MaxLength)
+		setInt(&config.MaxLength, gc.MaxNewTokens)
+		setInt(&config.NumBeams, gc.NumBeams)
+		setFloat64(&config.LengthPenalty, gc.LengthPenalty)
+		setBool(&config.EarlyStopping, gc.EarlyStopping)
+		setInt(&config.NoRepeatNgramSize, gc.NoRepeatNgramSize)
+		setFloat64(&config.RepetitionPenalty, gc.RepetitionPenalty)
+		setInt(&config.LoopRepeats, gc.LoopRepeats)
+	}
+
+	if config.MaxLength <= 0 {
+		return nil, fmt.Errorf("invalid maximum generation length %d", config.MaxLength)
+	}
+	if config.NumBeams < 1 {
+		config.NumBeams = 1
+	}
+	if config.RepetitionPenalty <= 0 {
+		return nil, fmt.Errorf("invalid repetition penalty %g", config.RepetitionPenalty)
+	}
+	if config.LoopRepeats < 0 {
+		return nil, fmt.Errorf("invalid loop repeat count %d", config.LoopRepeats)
+	}
+	return config, nil
+}
+
+// readJSONFile 解析 fsys 中的 JSON 文件，文件不存在时返回 false
+func readJSONFile(fsys fs.FS, name string, v interface{}) (bool, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return true, nil
+}
+
+func setInt64(dst *int64, src *int64) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func setInt(dst *int, src *int) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func setFloat64(dst *float64, src *float64) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func setBool(dst *bool, src *bool) {
+	if src != nil {
+		*dst = *src
+	}
+}
@@ -1,151 +1,232 @@
 package model_controller
 
 import (
+	"context"
 	"fmt"
+	"log"
+
 	onnxruntime "github.com/yalue/onnxruntime_go"
 )
 
+// DecoderConfig 解码配置，通常由 LoadDecoderConfig 从模型的 config.json 与 generation_config.json 读取。
+// encoder 输出的序列长度与隐藏层维度取自 encoder 输出张量的形状。
 type DecoderConfig struct {
 	BosTokenID          int64
 	EosTokenID          int64
-	MaxLength           int
+	MaxLength           int // 最多生成的 token 数（对应 max_new_tokens）
 	VocabSize           int
-	EncoderSeqLen       int // 578（来自encoder输出）
 	DecoderStartTokenID int64
+	NumBeams            int     // 束搜索宽度，<=1 时使用贪心解码（对应 config.json 的 num_beams）
+	LengthPenalty       float64 // 长度惩罚指数（对应 config.json 的 length_penalty）
+	EarlyStopping       bool    // 为 true 时收集满 NumBeams 个完成假设即停止（对应 early_stopping）
+	NoRepeatNgramSize   int     // 禁止重复出现的 n-gram 长度，0 表示不限制（对应 no_repeat_ngram_size）
+	RepetitionPenalty   float64 // 已出现 token 的惩罚系数，1.0 表示不惩罚（对应 repetition_penalty）
+	LoopRepeats         int     // 末尾同一短片段连续重复该次数时停止生成并标记为循环，0 表示不检测
+}
+
+// decoderSession 是 Decoder 用到的 onnxruntime session 方法，基准测试中可替换为桩实现
+type decoderSession interface {
+	Run(inputs, outputs []onnxruntime.Value) error
+	Destroy() error
 }
 
 type Decoder struct {
-	session *onnxruntime.DynamicAdvancedSession
+	session decoderSession
 	config  *DecoderConfig
-}
+	grammar *latexGrammar // 非 nil 时在解码时约束 LaTeX 结构
 
-var (
-	decoderInst *Decoder
-)
+	// 以下字段仅在模型带有 past_key_values 输入（KV cache 模式）时使用
+	useCache       bool
+	hasCacheBranch bool                          // 合并导出的模型带有 use_cache_branch 输入
+	pastInputs     []onnxruntime.InputOutputInfo // past_key_values.* 输入，顺序与 session 输入一致
+}
 
-func NewDecoder(modelPath string, useCoreML bool, useCUDA bool) (*Decoder, error) {
-	if decoderInst == nil {
-		decoderInst = &Decoder{}
-		var err error
-		config := &DecoderConfig{
-			BosTokenID:          1,
-			EosTokenID:          2,
-			MaxLength:           512,
-			VocabSize:           1200,
-			EncoderSeqLen:       578,
-			DecoderStartTokenID: 2,
-		}
+// NewDecoder 创建 decoder，config 为 nil 时使用 DefaultDecoderConfig
+func NewDecoder(modelData []byte, config *DecoderConfig, opts SessionOptions) (*Decoder, error) {
+	d := &Decoder{}
+	var err error
+	if config == nil {
+		config = DefaultDecoderConfig()
+	}
+	copied := *config
+	d.config = &copied
 
-		decoderInst.config = config
+	options, err := opts.newSessionOptions()
 
-		options, err := onnxruntime.NewSessionOptions()
+	if err != nil {
+		return nil, err
+	}
+	defer options.Destroy()
 
-		if err != nil {
-			return nil, err
-		}
+	// 根据模型的输入名称自动选择是否使用 KV cache
+	inputs, _, err := onnxruntime.GetInputOutputInfoWithONNXData(modelData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decoder inputs: %w", err)
+	}
+	inputNames, outputNames, err := d.detectCacheMode(inputs)
+	if err != nil {
+		return nil, err
+	}
+	if d.useCache {
+		log.Printf("Decoder: using past key/values cache (%d cached tensors)", len(d.pastInputs))
+	} else {
+		log.Println("Decoder: no past key/values inputs found, using cache-less decoding")
+	}
 
-		if useCoreML {
-			err := options.AppendExecutionProviderCoreML(0)
-			if err != nil {
-				return nil, err
-			}
-		}
+	session, err := onnxruntime.NewDynamicAdvancedSessionWithONNXData(
+		modelData,
+		inputNames,
+		outputNames,
+		options,
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.session = session
+	return d, nil
+}
 
-		if useCUDA {
-			cudaOptions, err := onnxruntime.NewCUDAProviderOptions()
-			if err != nil {
-				return nil, err
-			}
-			err = options.AppendExecutionProviderCUDA(cudaOptions)
-			if err != nil {
-				return nil, err
-			}
-		}
+// SetBeamSearch 配置束搜索参数，numBeams <= 1 时恢复贪心解码
+func (d *Decoder) SetBeamSearch(numBeams int, lengthPenalty float64, earlyStopping bool) {
+	if numBeams < 1 {
+		numBeams = 1
+	}
+	d.config.NumBeams = numBeams
+	d.config.LengthPenalty = lengthPenalty
+	d.config.EarlyStopping = earlyStopping
+}
 
-		decoderInst.session, err = onnxruntime.NewDynamicAdvancedSession(
-			modelPath,
-			[]string{"input_ids", "encoder_hidden_states"},
-			[]string{"logits"},
-			options,
-		)
-		if err != nil {
-			return nil, err
-		}
+// SetLoopRepeats 设置循环检测的重复次数，0 表示不检测
+func (d *Decoder) SetLoopRepeats(repeats int) {
+	if repeats < 0 {
+		repeats = 0
 	}
-	return decoderInst, nil
+	d.config.LoopRepeats = repeats
 }
 
+// SetGrammar 设置解码时使用的 LaTeX 结构约束，nil 表示不约束
+func (d *Decoder) SetGrammar(g *latexGrammar) {
+	d.grammar = g
+}
+
+// Close 释放 decoder 的 session（onnxruntime 环境由调用方负责销毁）
 func (d *Decoder) Close() {
-	onnxruntime.DestroyEnvironment()
+	if d.session != nil {
+		d.session.Destroy()
+	}
 }
 
-func (d *Decoder) decodeStep(
-	inputIDs []int64,
-	encoderStates []float32, // [batch][seq_len][hidden_size]
-) ([]float32, error) {
-	// 创建输入张量
-	inputTensor, _ := onnxruntime.NewTensor(
-		onnxruntime.NewShape(1, int64(len(inputIDs))), // [batch=1, seq_len]
-		inputIDs,
-	)
-	defer inputTensor.Destroy()
+// Generation 是一次生成的结果
+type Generation struct {
+	Tokens   []uint32  // 生成的 token（包含起始 token 与 EOS）
+	LogProbs []float32 // 每个 token 在原始 logits（重复惩罚与语法约束之前）下的对数概率，与 Tokens 对齐，起始 token 为 0
+	Score    float64   // 序列得分，基于约束后的分布（束搜索时为长度惩罚后的得分，贪心时为对数概率之和）
+	Looped   bool      // 因检测到重复循环而提前停止
+}
 
-	encoderTensor, _ := onnxruntime.NewTensor(
-		onnxruntime.NewShape(1, int64(d.config.EncoderSeqLen), 384), // [1, 578, 384]
-		encoderStates,
-	)
-	defer encoderTensor.Destroy()
+// StepFunc 在每生成一个 token 后被调用，参数为当前（束搜索时为得分最高的）序列，包含起始 token
+type StepFunc func(tokens []uint32)
 
-	output := []onnxruntime.Value{nil}
+// Generate 根据 encoder 输出生成 token 序列，NumBeams > 1 时使用束搜索，否则使用贪心解码。
+// 每一步解码前检查 ctx，取消或超时时返回 ctx.Err()。
+func (d *Decoder) Generate(ctx context.Context, encoderOut *EncoderOutput) (*Generation, error) {
+	return d.GenerateStream(ctx, encoderOut, nil)
+}
 
-	// 执行推理
-	err := d.session.Run(
-		[]onnxruntime.Value{inputTensor, encoderTensor},
-		output,
-	)
+// GenerateStream 与 Generate 相同，但每一步都会调用 onStep（可以为 nil）报告部分结果
+func (d *Decoder) GenerateStream(ctx context.Context, encoderOut *EncoderOutput, onStep StepFunc) (*Generation, error) {
+	if d.config.NumBeams > 1 {
+		hyps, err := d.beamSearch(ctx, encoderOut, d.config.NumBeams, onStep)
+		if err != nil {
+			return nil, err
+		}
+		return hyps[0].generation(d.config.LengthPenalty), nil
+	}
+	return d.greedySearch(ctx, encoderOut, onStep)
+}
 
+// GenerateNBest 使用束搜索返回得分最高的 n 个候选序列（按得分从高到低排序）。
+// 束宽取 n 与配置的 NumBeams 中较大者。
+func (d *Decoder) GenerateNBest(ctx context.Context, encoderOut *EncoderOutput, n int) ([]*Generation, error) {
+	numBeams := d.config.NumBeams
+	if n > numBeams {
+		numBeams = n
+	}
+	hyps, err := d.beamSearch(ctx, encoderOut, numBeams, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	// 获取logits输出
-	logitsTensor := output[0].(*onnxruntime.Tensor[float32])
-
-	defer logitsTensor.Destroy()
-
-	return logitsTensor.GetData(), nil
+	gens := make([]*Generation, 0, len(hyps))
+	for _, h := range hyps {
+		gens = append(gens, h.generation(d.config.LengthPenalty))
+	}
+	return gens, nil
 }
 
-func (d *Decoder) Generate(encoderOut []float32) ([]uint32, error) {
+// greedySearch 每一步选择概率最大的 token
+func (d *Decoder) greedySearch(ctx context.Context, encoderOut *EncoderOutput, onStep StepFunc) (*Generation, error) {
+	g, err := d.newGeneration(encoderOut)
+	if err != nil {
+		return nil, err
+	}
+	defer g.Destroy()
+
 	// 初始化生成序列
-	generatedIDs := []int64{d.config.DecoderStartTokenID}
+	generatedIDs := make([]int64, 1, d.config.MaxLength+1)
+	generatedIDs[0] = d.config.DecoderStartTokenID
+	logProbs := make([]float32, 1, d.config.MaxLength+1)
+	var score float64
+	var looped bool
+	var grammar *latexState
+	if d.grammar != nil {
+		grammar = newLatexState()
+	}
+	var past *kvCache
+	defer func() { past.release() }()
 
 	for len(generatedIDs) <= d.config.MaxLength {
-		// 执行单步解码
-		logits, err := d.decodeStep(generatedIDs, encoderOut)
+		if err := ctx.Err(); err != nil {
+			return &Generation{Tokens: int64ToUint32Slice(generatedIDs), LogProbs: logProbs, Score: score}, err
+		}
+
+		// 执行单步解码，获取最后一个位置的logits
+		lastLogits, next, err := g.step(generatedIDs, past)
 
 		if err != nil {
-			return int64ToUint32Slice(generatedIDs), err
+			return &Generation{Tokens: int64ToUint32Slice(generatedIDs), LogProbs: logProbs, Score: score}, err
 		}
+		past.release()
+		past = next
 
-		// 获取最后一个位置的logits
-		lastLogits := extractLastLogits(logits, len(generatedIDs), d.config.VocabSize)
-
-		// 选择下一个token
+		// 选择下一个token；LogProbs 记录模型原始分布下的概率，不受重复惩罚与语法约束影响
+		rawLogProbs := logSoftmax(lastLogits)
+		d.processLogits(lastLogits, generatedIDs)
+		if grammar != nil {
+			d.grammar.mask(lastLogits, grammar, d.config.EosTokenID)
+		}
 		nextID := argmax(lastLogits)
 		generatedIDs = append(generatedIDs, nextID)
+		logProbs = append(logProbs, rawLogProbs[nextID])
+		score += float64(logSoftmax(lastLogits)[nextID])
+		if grammar != nil {
+			grammar = d.grammar.advance(grammar, nextID)
+		}
+		if onStep != nil {
+			onStep(int64ToUint32Slice(generatedIDs))
+		}
 
 		// 终止条件
 		if nextID == d.config.EosTokenID {
 			break
 		}
+		if detectLoop(generatedIDs, d.config.LoopRepeats) {
+			log.Printf("Decoder: repetition loop detected after %d tokens, stopping", len(generatedIDs))
+			looped = true
+			break
+		}
 	}
 
-	for _, i := range generatedIDs {
-		fmt.Printf("%d ", i)
-	}
-
-	return int64ToUint32Slice(generatedIDs), nil
+	return &Generation{Tokens: int64ToUint32Slice(generatedIDs), LogProbs: logProbs, Score: score, Looped: looped}, nil
 }
 
 // 将int64切片转换为uint32切片
@@ -1,6 +1,8 @@
 package model_controller
 
 import (
+	"fmt"
+
 	onnxruntime "github.com/yalue/onnxruntime_go"
 )
 
@@ -10,81 +12,78 @@ type Encoder struct {
 	//outputTensor *onnxruntime.Tensor[float32]
 }
 
-var (
-	encoder *Encoder
-)
-
-func NewEncoder(modelPath string, useCoreML bool, useCUDA bool) (*Encoder, error) {
-	if encoder == nil {
-		encoder = &Encoder{}
-		var err error
-
-		inputName := []string{"pixel_values"}
-		outputName := []string{"last_hidden_state"}
-
-		options, err := onnxruntime.NewSessionOptions()
+// NewEncoder 从内存中的 ONNX 模型数据创建 encoder session
+func NewEncoder(modelData []byte, opts SessionOptions) (*Encoder, error) {
+	encoder := &Encoder{}
+	var err error
 
-		if err != nil {
-			return nil, err
-		}
+	inputName := []string{"pixel_values"}
+	outputName := []string{"last_hidden_state"}
 
-		if useCoreML {
-			err := options.AppendExecutionProviderCoreML(0)
-			if err != nil {
-				return nil, err
-			}
-		}
+	options, err := opts.newSessionOptions()
 
-		if useCUDA {
-			cudaOptions, err := onnxruntime.NewCUDAProviderOptions()
-			if err != nil {
-				return nil, err
-			}
-			err = options.AppendExecutionProviderCUDA(cudaOptions)
-			if err != nil {
-				return nil, err
-			}
-		}
+	if err != nil {
+		return nil, err
+	}
+	defer options.Destroy()
 
-		//encoder.inputTensor, err = onnxruntime.NewEmptyTensor[float32](onnxruntime.NewShape(1, 3, 384, 384))
-		//
-		//if err != nil {
-		//	return nil, err
-		//}
-		//
-		//encoder.outputTensor, err = onnxruntime.NewEmptyTensor[float32](onnxruntime.NewShape(1, 578, 384))
-		//
-		//if err != nil {
-		//	return nil, err
-		//}
+	//encoder.inputTensor, err = onnxruntime.NewEmptyTensor[float32](onnxruntime.NewShape(1, 3, 384, 384))
+	//
+	//if err != nil {
+	//	return nil, err
+	//}
+	//
+	//encoder.outputTensor, err = onnxruntime.NewEmptyTensor[float32](onnxruntime.NewShape(1, 578, 384))
+	//
+	//if err != nil {
+	//	return nil, err
+	//}
 
-		encoder.session, err = onnxruntime.NewDynamicAdvancedSession(
-			modelPath,
-			inputName,
-			outputName,
-			options,
-		)
+	encoder.session, err = onnxruntime.NewDynamicAdvancedSessionWithONNXData(
+		modelData,
+		inputName,
+		outputName,
+		options,
+	)
 
-		if err != nil {
-			return nil, err
-		}
+	if err != nil {
+		return nil, err
 	}
 	return encoder, nil
 }
 
-func (encoder *Encoder) Run(inputTensor []onnxruntime.Value) ([]float32, error) {
+// Close 释放 encoder 的 session
+func (encoder *Encoder) Close() {
+	if encoder.session != nil {
+		encoder.session.Destroy()
+	}
+}
+
+// EncoderOutput 是 encoder 的 last_hidden_state 输出
+type EncoderOutput struct {
+	Data  []float32
+	Shape onnxruntime.Shape // [batch, seq_len, hidden_size]
+}
+
+func (encoder *Encoder) Run(inputTensor []onnxruntime.Value) (*EncoderOutput, error) {
 	r := []onnxruntime.Value{nil}
 	err := encoder.session.Run(
 		inputTensor,
 		r,
 	)
-	defer r[0].Destroy()
+	// 失败时输出可能未被创建
+	if r[0] != nil {
+		defer r[0].Destroy()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	labelTensor := r[0].(*onnxruntime.Tensor[float32])
+	labelTensor, ok := r[0].(*onnxruntime.Tensor[float32])
+	if !ok {
+		return nil, fmt.Errorf("unexpected encoder output type %T", r[0])
+	}
 	predictedLabels := labelTensor.GetData()
 
-	return predictedLabels, nil
+	return &EncoderOutput{Data: predictedLabels, Shape: labelTensor.GetShape()}, nil
 }
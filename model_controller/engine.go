@@ -0,0 +1,262 @@
+package model_controller
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+)
+
+// Files making up a VisionEncoderDecoder ONNX export, relative to the root of its model filesystem.
+const (
+	EncoderModelFile       = "encoder_model.onnx"
+	DecoderModelFile       = "decoder_model.onnx"
+	MergedDecoderModelFile = "decoder_model_merged.onnx" // optional decoder with past key/values
+	TokenizerFile          = "tokenizer.json"
+	ConfigFile             = "config.json"
+	GenerationConfigFile   = "generation_config.json"   // optional
+	PreprocessorConfigFile = "preprocessor_config.json" // optional
+)
+
+// EngineConfig describes the files and options an Engine is built from.
+type EngineConfig struct {
+	// ModelFS holds the ONNX export at its root: the encoder, a decoder (the
+	// merged decoder with past key/values is preferred when present), the
+	// tokenizer and the model's config files. Models are loaded into memory
+	// from it, so an embed.FS works as well as os.DirFS.
+	ModelFS fs.FS
+
+	KaTeXJS       []byte // katex.min.js, used for MathML output
+	MathML2OMMLJS []byte // mathml2omml.js, used for OMML output
+
+	// PoolSize is the number of encoder/decoder session pairs, i.e. how many
+	// images can be recognized in parallel. Values below 1 mean 1.
+	PoolSize int
+	// Session configures every ONNX session in the pool.
+	Session SessionOptions
+	// Cache configures the result cache; the zero value disables it.
+	Cache CacheConfig
+	// Preprocess selects optional image preprocessing on top of the model's
+	// preprocessor_config.json; the zero value matches the model's training.
+	Preprocess PreprocessOptions
+}
+
+// EngineStatus describes an engine's session pool.
+type EngineStatus struct {
+	PoolSize     int // number of encoder/decoder session pairs
+	IdleSessions int // session pairs not currently recognizing an image
+	Session      SessionOptions
+	Cache        CacheStats
+}
+
+// Engine owns a tokenizer, a pool of encoder/decoder ONNX sessions and the
+// format converters. Several engines can live in one process; the
+// onnxruntime environment itself must be initialized by the caller
+// beforehand. An Engine is safe for concurrent use: each recognition takes a
+// session pair from the pool, waiting if none is idle.
+type Engine struct {
+	tokenizer     *Tokenizer
+	grammar       *latexGrammar
+	pool          *sessionPool
+	eosTokenID    int64
+	preprocessor  *Preprocessor
+	katexJS       []byte
+	mathml2ommlJS []byte
+	session       SessionOptions
+
+	// closeMu is held for reading while a recognition runs and for writing
+	// while Close destroys the sessions and the tokenizer.
+	closeMu   sync.RWMutex
+	closeOnce sync.Once
+
+	cache   *resultCache // nil when caching is disabled
+	modelID string       // hash of the model files, part of every cache key
+
+	// Current decoding settings, part of every cache key.
+	decodingMu         sync.Mutex
+	numBeams           int
+	lengthPenalty      float64
+	earlyStopping      bool
+	loopRepeats        int
+	grammarConstrained bool
+}
+
+// New loads the tokenizer and models described by cfg.
+func New(cfg EngineConfig) (*Engine, error) {
+	if len(cfg.KaTeXJS) == 0 {
+		log.Println("Warning: KaTeX JS data is empty; MathML output will be unavailable.")
+	}
+	if len(cfg.MathML2OMMLJS) == 0 {
+		log.Println("Warning: mathml2omml.js data is empty; OMML output will be unavailable.")
+	}
+
+	e := &Engine{
+		katexJS:       cfg.KaTeXJS,
+		mathml2ommlJS: cfg.MathML2OMMLJS,
+		session:       cfg.Session,
+	}
+
+	decoderConfig, err := LoadDecoderConfig(cfg.ModelFS)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to load decoder config: %w", ErrModelsNotLoaded, err)
+	}
+	log.Printf("Decoder config: %+v", *decoderConfig)
+	e.eosTokenID = decoderConfig.EosTokenID
+
+	preprocessorConfig, err := LoadPreprocessorConfig(cfg.ModelFS)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to load preprocessor config: %w", ErrModelsNotLoaded, err)
+	}
+	e.preprocessor, err = NewPreprocessor(preprocessorConfig, cfg.Preprocess)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid preprocessor config: %w", ErrModelsNotLoaded, err)
+	}
+	log.Printf("Preprocessor config: %+v, options: %+v", *preprocessorConfig, cfg.Preprocess)
+
+	tokenizerData, err := fs.ReadFile(cfg.ModelFS, TokenizerFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read tokenizer: %w", ErrTokenizerNotLoaded, err)
+	}
+	e.tokenizer, err = NewTokenizer(tokenizerData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to initialize tokenizer: %w", ErrTokenizerNotLoaded, err)
+	}
+	e.grammar, err = newLatexGrammar(tokenizerData)
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("%w: %w", ErrTokenizerNotLoaded, err)
+	}
+
+	encoderData, err := fs.ReadFile(cfg.ModelFS, EncoderModelFile)
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("%w: failed to read encoder model: %w", ErrModelsNotLoaded, err)
+	}
+	decoderData, err := readDecoderModel(cfg.ModelFS)
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("%w: %w", ErrModelsNotLoaded, err)
+	}
+	e.pool, err = newSessionPool(cfg.PoolSize, encoderData, decoderData, decoderConfig, cfg.Session)
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("%w: %w", ErrModelsNotLoaded, err)
+	}
+	e.numBeams, e.lengthPenalty, e.earlyStopping = decoderConfig.NumBeams, decoderConfig.LengthPenalty, decoderConfig.EarlyStopping
+	e.loopRepeats = decoderConfig.LoopRepeats
+
+	if cfg.Cache.Entries > 0 {
+		e.modelID = modelIdentity(encoderData, decoderData, tokenizerData, []byte(fmt.Sprintf("%+v", *decoderConfig)))
+		e.cache = newResultCache(cfg.Cache)
+		log.Printf("Result cache enabled: %d entries in memory, directory %q", cfg.Cache.Entries, cfg.Cache.Dir)
+	}
+	log.Printf("Encoder and Decoder initialized successfully: pool size %d, session options %+v", len(e.pool.pairs), e.session)
+	return e, nil
+}
+
+// Status reports the size and current use of the session pool. It returns
+// ErrModelsNotLoaded once the engine has been closed.
+func (e *Engine) Status() (EngineStatus, error) {
+	if e.pool.isClosed() {
+		return EngineStatus{}, ErrModelsNotLoaded
+	}
+	return EngineStatus{
+		PoolSize:     len(e.pool.pairs),
+		IdleSessions: len(e.pool.idle),
+		Session:      e.session,
+		Cache:        e.CacheStats(),
+	}, nil
+}
+
+// CacheStats reports the result cache's size, hits and misses. It returns
+// zero stats when caching is disabled.
+func (e *Engine) CacheStats() CacheStats {
+	if e.cache == nil {
+		return CacheStats{}
+	}
+	return e.cache.stats()
+}
+
+// ClearCache removes every cached result from memory and disk.
+func (e *Engine) ClearCache() error {
+	if e.cache == nil {
+		return nil
+	}
+	return e.cache.clear()
+}
+
+// Close releases the tokenizer and ONNX sessions owned by the engine. It
+// waits for running recognitions to finish; recognitions still waiting for
+// a session pair, and any started afterwards, fail with ErrModelsNotLoaded.
+// Calling Close more than once has no further effect.
+func (e *Engine) Close() {
+	e.closeOnce.Do(func() {
+		// The pool is nil only when New fails before creating it.
+		if e.pool != nil {
+			e.pool.shutdown()
+		}
+		e.closeMu.Lock()
+		defer e.closeMu.Unlock()
+		if e.pool != nil {
+			e.pool.close()
+		}
+		if e.tokenizer != nil {
+			e.tokenizer.Close()
+		}
+	})
+}
+
+// ValidateModelDir checks that dir holds a usable model export: the encoder,
+// a decoder and the tokenizer must exist, and any config files present must
+// parse.
+func ValidateModelDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	fsys := os.DirFS(dir)
+	for _, name := range []string{EncoderModelFile, TokenizerFile} {
+		if _, err := fs.Stat(fsys, name); err != nil {
+			return fmt.Errorf("missing %s: %w", name, err)
+		}
+	}
+	if _, err := fs.Stat(fsys, MergedDecoderModelFile); err != nil {
+		if _, err := fs.Stat(fsys, DecoderModelFile); err != nil {
+			return fmt.Errorf("missing %s or %s: %w", MergedDecoderModelFile, DecoderModelFile, err)
+		}
+	}
+	if _, err := LoadDecoderConfig(fsys); err != nil {
+		return err
+	}
+	config, err := LoadPreprocessorConfig(fsys)
+	if err != nil {
+		return err
+	}
+	if _, err := NewPreprocessor(config, PreprocessOptions{}); err != nil {
+		return fmt.Errorf("invalid %s: %w", PreprocessorConfigFile, err)
+	}
+	return nil
+}
+
+// readDecoderModel reads the merged decoder with past key/values if the
+// export has one, and the plain decoder otherwise.
+func readDecoderModel(fsys fs.FS) ([]byte, error) {
+	data, err := fs.ReadFile(fsys, MergedDecoderModelFile)
+	if err == nil {
+		log.Printf("Using %s", MergedDecoderModelFile)
+		return data, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read decoder model: %w", err)
+	}
+	data, err = fs.ReadFile(fsys, DecoderModelFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decoder model: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,25 @@
+package model_controller
+
+import "errors"
+
+// Errors returned by New and the Engine's Predict methods wrap one of these,
+// so callers can tell the failing stage apart with errors.Is. Cancellation
+// is reported by additionally wrapping the context's error.
+var (
+	// ErrModelsNotLoaded means the ONNX models could not be loaded or the
+	// engine has been closed.
+	ErrModelsNotLoaded = errors.New("models not loaded")
+	// ErrTokenizerNotLoaded means the tokenizer could not be loaded or the
+	// engine has been closed.
+	ErrTokenizerNotLoaded = errors.New("tokenizer not loaded")
+	// ErrImageDecode means the image data could not be decoded or
+	// preprocessed.
+	ErrImageDecode = errors.New("could not decode image")
+	// ErrEncoder means running the encoder failed.
+	ErrEncoder = errors.New("encoder failed")
+	// ErrDecoder means generating tokens with the decoder failed.
+	ErrDecoder = errors.New("decoder failed")
+	// ErrConversion means converting the recognized LaTeX into the requested
+	// output format failed, or the format is not supported.
+	ErrConversion = errors.New("format conversion failed")
+)
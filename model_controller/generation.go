@@ -0,0 +1,152 @@
+package model_controller
+
+import (
+	"fmt"
+
+	onnxruntime "github.com/yalue/onnxruntime_go"
+)
+
+// generation 保存一张图片解码过程中可复用的张量：
+// encoder_hidden_states 只创建一次，input_ids 使用预分配的缓冲区，
+// KV cache 模式下的 use_cache_branch、占位 past 以及 cross-attention key/values 也只创建一次。
+type generation struct {
+	d             *Decoder
+	encoderTensor *onnxruntime.Tensor[float32]
+	idsBuffer     []int64
+
+	// 以下字段仅在 KV cache 模式下使用
+	cacheBranch [2]*onnxruntime.Tensor[bool] // use_cache_branch = false / true
+	dummyPast   []onnxruntime.Value
+	cross       []onnxruntime.Value // 第一步得到的 cross-attention key/values，下标与 Decoder.pastInputs 一致
+}
+
+// newGeneration 为一张图片的 encoder 输出创建解码所需的张量
+func (d *Decoder) newGeneration(encoderOut *EncoderOutput) (*generation, error) {
+	if len(encoderOut.Shape) != 3 {
+		return nil, fmt.Errorf("unexpected encoder output shape %v, want [batch, seq_len, hidden_size]", encoderOut.Shape)
+	}
+	g := &generation{
+		d:         d,
+		idsBuffer: make([]int64, d.config.MaxLength+1),
+	}
+
+	var err error
+	g.encoderTensor, err = onnxruntime.NewTensor(
+		encoderOut.Shape.Clone(), // [1, seq_len, hidden_size]，pix2text-mfr 为 [1, 578, 384]
+		encoderOut.Data,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encoder_hidden_states tensor: %w", err)
+	}
+
+	if d.useCache {
+		for i, useCache := range []bool{false, true} {
+			g.cacheBranch[i], err = onnxruntime.NewTensor(onnxruntime.NewShape(1), []bool{useCache})
+			if err != nil {
+				g.Destroy()
+				return nil, fmt.Errorf("failed to create %s tensor: %w", useCacheBranchInput, err)
+			}
+		}
+		g.cross = make([]onnxruntime.Value, len(d.pastInputs))
+		for _, info := range d.pastInputs {
+			t, err := dummyPast(info)
+			if err != nil {
+				g.Destroy()
+				return nil, fmt.Errorf("failed to create placeholder %s tensor: %w", info.Name, err)
+			}
+			g.dummyPast = append(g.dummyPast, t)
+		}
+	}
+	return g, nil
+}
+
+// Destroy 释放本次解码创建的张量
+func (g *generation) Destroy() {
+	if g.encoderTensor != nil {
+		g.encoderTensor.Destroy()
+	}
+	for _, t := range g.cacheBranch {
+		if t != nil {
+			t.Destroy()
+		}
+	}
+	for _, values := range [][]onnxruntime.Value{g.dummyPast, g.cross} {
+		for _, v := range values {
+			if v != nil {
+				v.Destroy()
+			}
+		}
+	}
+}
+
+// step 执行单步解码，返回最后一个位置的 logits 以及更新后的 KV cache。
+// 无 cache 模式下每一步都输入完整的 inputIDs，past 始终为 nil；
+// KV cache 模式下已有 past 时只输入最后一个 token。
+func (g *generation) step(inputIDs []int64, past *kvCache) ([]float32, *kvCache, error) {
+	d := g.d
+	stepIDs := inputIDs
+	if past != nil {
+		stepIDs = inputIDs[len(inputIDs)-1:]
+	}
+	if len(stepIDs) > len(g.idsBuffer) {
+		g.idsBuffer = make([]int64, len(stepIDs))
+	}
+	n := copy(g.idsBuffer, stepIDs)
+
+	// 创建输入张量
+	inputTensor, err := onnxruntime.NewTensor(
+		onnxruntime.NewShape(1, int64(n)), // [batch=1, seq_len]
+		g.idsBuffer[:n],
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create input_ids tensor: %w", err)
+	}
+	defer inputTensor.Destroy()
+
+	inputs := []onnxruntime.Value{inputTensor, g.encoderTensor}
+	if d.useCache {
+		if past == nil {
+			inputs = append(inputs, g.cacheBranch[0])
+			inputs = append(inputs, g.dummyPast...)
+		} else {
+			inputs = append(inputs, g.cacheBranch[1])
+			for i, v := range past.values {
+				if v == nil {
+					v = g.cross[i]
+				}
+				inputs = append(inputs, v)
+			}
+		}
+	}
+
+	output := make([]onnxruntime.Value, 1+len(d.pastInputs))
+
+	// 执行推理
+	if err := d.session.Run(inputs, output); err != nil {
+		return nil, nil, err
+	}
+
+	// 获取logits输出
+	logitsTensor := output[0].(*onnxruntime.Tensor[float32])
+	defer logitsTensor.Destroy()
+
+	var next *kvCache
+	if d.useCache {
+		next = &kvCache{values: make([]onnxruntime.Value, len(d.pastInputs)), refs: 1}
+		for i, v := range output[1:] {
+			if !isCrossAttention(d.pastInputs[i].Name) {
+				next.values[i] = v
+				continue
+			}
+			// cross-attention key/values 只保留第一步的结果
+			if g.cross[i] == nil {
+				g.cross[i] = v
+			} else {
+				v.Destroy()
+			}
+		}
+	}
+
+	shape := logitsTensor.GetShape() // [1, seq_len, vocab_size]
+	return extractLastLogits(logitsTensor.GetData(), int(shape[1]), int(shape[2])), next, nil
+}
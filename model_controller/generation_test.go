@@ -0,0 +1,111 @@
+package model_controller
+
+import (
+	"os"
+	"testing"
+
+	onnxruntime "github.com/yalue/onnxruntime_go"
+)
+
+// benchmarkFormulaTokens 是基准测试中模拟的公式长度（解码步数）
+const benchmarkFormulaTokens = 64
+
+// initBenchmarkRuntime 使用 ONNXRUNTIME_SHARED_LIBRARY_PATH 指定的动态库初始化 onnxruntime。
+// 创建张量也需要该动态库，没有纯 Go 的替代实现，因此未设置该变量时基准测试会被跳过，CI 中不会运行。
+func initBenchmarkRuntime(b *testing.B) {
+	b.Helper()
+	if onnxruntime.IsInitialized() {
+		return
+	}
+	libPath := os.Getenv("ONNXRUNTIME_SHARED_LIBRARY_PATH")
+	if libPath == "" {
+		b.Skip("ONNXRUNTIME_SHARED_LIBRARY_PATH not set")
+	}
+	onnxruntime.SetSharedLibraryPath(libPath)
+	if err := onnxruntime.InitializeEnvironment(); err != nil {
+		b.Fatalf("failed to initialize onnxruntime: %v", err)
+	}
+}
+
+// BenchmarkDecoderInputsPerStep 模拟旧的解码循环：每一步都重新创建 encoder_hidden_states 与 input_ids
+func BenchmarkDecoderInputsPerStep(b *testing.B) {
+	initBenchmarkRuntime(b)
+	encoderOut := make([]float32, 578*384)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ids := []int64{2}
+		for step := 0; step < benchmarkFormulaTokens; step++ {
+			inputTensor, err := onnxruntime.NewTensor(onnxruntime.NewShape(1, int64(len(ids))), ids)
+			if err != nil {
+				b.Fatal(err)
+			}
+			encoderTensor, err := onnxruntime.NewTensor(onnxruntime.NewShape(1, 578, 384), encoderOut)
+			if err != nil {
+				b.Fatal(err)
+			}
+			inputTensor.Destroy()
+			encoderTensor.Destroy()
+			ids = append(ids, int64(step))
+		}
+	}
+}
+
+// stubDecoderSession 代替 decoder 的 session：不做推理，只按 input_ids 的长度返回全零的 logits
+type stubDecoderSession struct {
+	vocabSize int
+	logits    []float32
+}
+
+func (s *stubDecoderSession) Run(inputs, outputs []onnxruntime.Value) error {
+	seqLen := inputs[0].GetShape()[1]
+	logits, err := onnxruntime.NewTensor(
+		onnxruntime.NewShape(1, seqLen, int64(s.vocabSize)),
+		s.logits[:int(seqLen)*s.vocabSize],
+	)
+	if err != nil {
+		return err
+	}
+	outputs[0] = logits
+	return nil
+}
+
+func (s *stubDecoderSession) Destroy() error {
+	return nil
+}
+
+// BenchmarkDecoderInputsPerImage 通过 newGeneration 与 generation.step 解码（不使用 KV cache），
+// encoder_hidden_states 每张图片只创建一次，input_ids 复用预分配的缓冲区。
+// 推理由 stubDecoderSession 代替，因此测得的只是准备输入与读取 logits 的开销。
+// 未设置 ONNXRUNTIME_SHARED_LIBRARY_PATH 时跳过。
+func BenchmarkDecoderInputsPerImage(b *testing.B) {
+	initBenchmarkRuntime(b)
+	const vocabSize = 1200
+	encoderOut := &EncoderOutput{Data: make([]float32, 578*384), Shape: onnxruntime.NewShape(1, 578, 384)}
+	d := &Decoder{
+		session: &stubDecoderSession{
+			vocabSize: vocabSize,
+			logits:    make([]float32, (benchmarkFormulaTokens+1)*vocabSize),
+		},
+		config: &DecoderConfig{MaxLength: benchmarkFormulaTokens, VocabSize: vocabSize},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		g, err := d.newGeneration(encoderOut)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids := make([]int64, 1, benchmarkFormulaTokens+1)
+		ids[0] = 2
+		for step := 0; step < benchmarkFormulaTokens; step++ {
+			if _, _, err := g.step(ids, nil); err != nil {
+				b.Fatal(err)
+			}
+			ids = append(ids, int64(step))
+		}
+		g.Destroy()
+	}
+}
@@ -0,0 +1,101 @@
+package model_controller
+
+import (
+	"fmt"
+	"strings"
+
+	onnxruntime "github.com/yalue/onnxruntime_go"
+)
+
+const (
+	pastKeyValuesPrefix = "past_key_values"
+	presentPrefix       = "present"
+	useCacheBranchInput = "use_cache_branch"
+)
+
+// kvCache 保存一条序列已解码部分的 self-attention past key/values，顺序与 Decoder.pastInputs 一致，
+// cross-attention 对应的位置为 nil（由 generation 统一保存）。
+// 束搜索中多条 beam 可能共享同一个 cache，因此使用引用计数管理张量的释放。
+type kvCache struct {
+	values []onnxruntime.Value
+	refs   int
+}
+
+func (c *kvCache) retain() *kvCache {
+	if c != nil {
+		c.refs++
+	}
+	return c
+}
+
+func (c *kvCache) release() {
+	if c == nil {
+		return
+	}
+	c.refs--
+	if c.refs > 0 {
+		return
+	}
+	for _, v := range c.values {
+		if v != nil {
+			v.Destroy()
+		}
+	}
+	c.values = nil
+}
+
+// detectCacheMode 根据模型输入判断是否为带 past key/values 的导出，返回 session 的输入与输出名称
+func (d *Decoder) detectCacheMode(inputs []onnxruntime.InputOutputInfo) ([]string, []string, error) {
+	inputNames := []string{"input_ids", "encoder_hidden_states"}
+	outputNames := []string{"logits"}
+
+	for _, info := range inputs {
+		switch {
+		case info.Name == useCacheBranchInput:
+			d.hasCacheBranch = true
+		case strings.HasPrefix(info.Name, pastKeyValuesPrefix):
+			d.pastInputs = append(d.pastInputs, info)
+		}
+	}
+	d.useCache = len(d.pastInputs) > 0
+	if !d.useCache {
+		return inputNames, outputNames, nil
+	}
+	if !d.hasCacheBranch {
+		return nil, nil, fmt.Errorf("decoder has past key/values inputs but no %s input; export it as a merged decoder", useCacheBranchInput)
+	}
+
+	inputNames = append(inputNames, useCacheBranchInput)
+	for _, info := range d.pastInputs {
+		inputNames = append(inputNames, info.Name)
+		outputNames = append(outputNames, presentName(info.Name))
+	}
+	return inputNames, outputNames, nil
+}
+
+// presentName 将 past_key_values.0.decoder.key 映射为对应的输出 present.0.decoder.key
+func presentName(pastName string) string {
+	return presentPrefix + strings.TrimPrefix(pastName, pastKeyValuesPrefix)
+}
+
+// isCrossAttention 判断 past 输入是否为 cross-attention 的 key/values。
+// 它们只依赖 encoder 输出，在一张图片的整个解码过程中保持不变。
+func isCrossAttention(pastName string) bool {
+	return strings.Contains(pastName, ".encoder.")
+}
+
+// dummyPast 创建第一步解码（use_cache_branch=false）时使用的占位 past 张量。
+// 模型在该分支不会读取其内容；onnxruntime_go 不允许长度为 0 的维度，因此序列长度取 1。
+func dummyPast(info onnxruntime.InputOutputInfo) (*onnxruntime.Tensor[float32], error) {
+	shape := info.Dimensions.Clone()
+	if len(shape) != 4 {
+		return nil, fmt.Errorf("unexpected shape %v for decoder input %s", info.Dimensions, info.Name)
+	}
+	// [batch, num_heads, past_seq_len, head_dim]
+	shape[0] = 1
+	shape[2] = 1
+	if shape[1] <= 0 || shape[3] <= 0 {
+		return nil, fmt.Errorf("decoder input %s has dynamic head dimensions %v", info.Name, info.Dimensions)
+	}
+	return onnxruntime.NewEmptyTensor[float32](shape)
+}
@@ -0,0 +1,147 @@
+package model_controller
+
+import (
+	"reflect"
+	"testing"
+
+	onnxruntime "github.com/yalue/onnxruntime_go"
+)
+
+func pastInfo(name string) onnxruntime.InputOutputInfo {
+	return onnxruntime.InputOutputInfo{Name: name, Dimensions: onnxruntime.NewShape(-1, 8, -1, 32)}
+}
+
+func TestDetectCacheMode(t *testing.T) {
+	base := []onnxruntime.InputOutputInfo{{Name: "input_ids"}, {Name: "encoder_hidden_states"}}
+	past := []onnxruntime.InputOutputInfo{
+		pastInfo("past_key_values.0.decoder.key"),
+		pastInfo("past_key_values.0.decoder.value"),
+		pastInfo("past_key_values.0.encoder.key"),
+		pastInfo("past_key_values.0.encoder.value"),
+	}
+	tests := []struct {
+		name        string
+		inputs      []onnxruntime.InputOutputInfo
+		useCache    bool
+		inputNames  []string
+		outputNames []string
+		wantErr     bool
+	}{
+		{
+			name:        "cache-less export",
+			inputs:      base,
+			inputNames:  []string{"input_ids", "encoder_hidden_states"},
+			outputNames: []string{"logits"},
+		},
+		{
+			name:     "merged export",
+			inputs:   append(append(append([]onnxruntime.InputOutputInfo(nil), base...), onnxruntime.InputOutputInfo{Name: useCacheBranchInput}), past...),
+			useCache: true,
+			inputNames: []string{"input_ids", "encoder_hidden_states", useCacheBranchInput,
+				"past_key_values.0.decoder.key", "past_key_values.0.decoder.value",
+				"past_key_values.0.encoder.key", "past_key_values.0.encoder.value"},
+			outputNames: []string{"logits",
+				"present.0.decoder.key", "present.0.decoder.value",
+				"present.0.encoder.key", "present.0.encoder.value"},
+		},
+		{
+			name:    "past inputs without use_cache_branch",
+			inputs:  append(append([]onnxruntime.InputOutputInfo(nil), base...), past...),
+			wantErr: true,
+		},
+		{
+			// use_cache_branch 本身不代表需要 past
+			name:        "use_cache_branch without past inputs",
+			inputs:      append(append([]onnxruntime.InputOutputInfo(nil), base...), onnxruntime.InputOutputInfo{Name: useCacheBranchInput}),
+			inputNames:  []string{"input_ids", "encoder_hidden_states"},
+			outputNames: []string{"logits"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Decoder{}
+			inputNames, outputNames, err := d.detectCacheMode(tt.inputs)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.useCache != tt.useCache {
+				t.Errorf("useCache = %v, want %v", d.useCache, tt.useCache)
+			}
+			if !reflect.DeepEqual(inputNames, tt.inputNames) {
+				t.Errorf("input names = %v, want %v", inputNames, tt.inputNames)
+			}
+			if !reflect.DeepEqual(outputNames, tt.outputNames) {
+				t.Errorf("output names = %v, want %v", outputNames, tt.outputNames)
+			}
+		})
+	}
+}
+
+func TestPresentNameAndCrossAttention(t *testing.T) {
+	tests := []struct {
+		past    string
+		present string
+		cross   bool
+	}{
+		{"past_key_values.0.decoder.key", "present.0.decoder.key", false},
+		{"past_key_values.3.decoder.value", "present.3.decoder.value", false},
+		{"past_key_values.0.encoder.key", "present.0.encoder.key", true},
+		{"past_key_values.11.encoder.value", "present.11.encoder.value", true},
+	}
+	for _, tt := range tests {
+		if got := presentName(tt.past); got != tt.present {
+			t.Errorf("presentName(%q) = %q, want %q", tt.past, got, tt.present)
+		}
+		if got := isCrossAttention(tt.past); got != tt.cross {
+			t.Errorf("isCrossAttention(%q) = %v, want %v", tt.past, got, tt.cross)
+		}
+	}
+}
+
+// fakeValue 只记录 Destroy 的调用次数，其余方法不会被 kvCache 调用
+type fakeValue struct {
+	onnxruntime.Value
+	destroyed *int
+}
+
+func (v fakeValue) Destroy() error {
+	*v.destroyed++
+	return nil
+}
+
+func TestKVCacheReferenceCounting(t *testing.T) {
+	destroyed := 0
+	c := &kvCache{
+		values: []onnxruntime.Value{fakeValue{destroyed: &destroyed}, nil, fakeValue{destroyed: &destroyed}},
+		refs:   1,
+	}
+	// 两条 beam 共享同一个 cache
+	shared := c.retain()
+	if shared != c || c.refs != 2 {
+		t.Fatalf("retain() = %p with refs %d, want the same cache with refs 2", shared, c.refs)
+	}
+	c.release()
+	if destroyed != 0 {
+		t.Fatalf("%d tensors destroyed while the cache is still referenced", destroyed)
+	}
+	shared.release()
+	if destroyed != 2 {
+		t.Errorf("%d tensors destroyed after the last release, want 2 (nil entries skipped)", destroyed)
+	}
+	if c.values != nil {
+		t.Errorf("values = %v after the last release, want nil", c.values)
+	}
+
+	// nil cache（无 cache 模式）上的操作不做任何事
+	var none *kvCache
+	if none.retain() != nil {
+		t.Error("retain() on a nil cache returned a cache")
+	}
+	none.release()
+}
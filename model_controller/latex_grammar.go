@@ -0,0 +1,364 @@
+package model_controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// commandArgs 是需要必选参数的 LaTeX 命令及其参数个数
+var commandArgs = map[string]int{
+	"frac": 2, "dfrac": 2, "tfrac": 2, "cfrac": 2,
+	"binom": 2, "dbinom": 2, "tbinom": 2,
+	"stackrel": 2, "overset": 2, "underset": 2,
+	"sqrt": 1, "overline": 1, "underline": 1, "overbrace": 1, "underbrace": 1,
+	"hat": 1, "widehat": 1, "bar": 1, "vec": 1, "tilde": 1, "widetilde": 1,
+	"dot": 1, "ddot": 1, "check": 1, "breve": 1, "acute": 1, "grave": 1, "mathring": 1,
+	"overrightarrow": 1, "overleftarrow": 1, "xrightarrow": 1, "xleftarrow": 1,
+	"mathrm": 1, "mathbf": 1, "mathit": 1, "mathbb": 1, "mathcal": 1, "mathsf": 1,
+	"mathtt": 1, "mathfrak": 1, "boldsymbol": 1, "bm": 1, "operatorname": 1,
+	"text": 1, "textbf": 1, "textit": 1, "textrm": 1, "boxed": 1, "cancel": 1, "pmod": 1,
+}
+
+// structuralChars 是会改变 latexState 结构的字符，不含这些字符的 token 只会产生 atom
+const structuralChars = "{}\\^_"
+
+// latexGrammar 保存每个 token 解码后的文本，用于在解码时屏蔽会破坏 LaTeX 结构的 token
+type latexGrammar struct {
+	tokens []string // 下标为 token id
+	plain  []bool   // token 不含 structuralChars，在命令与环境名之外总是合法
+}
+
+func newLatexGrammarFromTokens(tokens []string) *latexGrammar {
+	g := &latexGrammar{tokens: tokens, plain: make([]bool, len(tokens))}
+	for id, tok := range tokens {
+		g.plain[id] = !strings.ContainsAny(tok, structuralChars)
+	}
+	return g
+}
+
+// newLatexGrammar 从 tokenizer.json 读取词表，并将 ByteLevel 编码的 token 还原为文本
+func newLatexGrammar(tokenizerJSON []byte) (*latexGrammar, error) {
+	var tj struct {
+		Model struct {
+			Vocab map[string]int `json:"vocab"`
+		} `json:"model"`
+		AddedTokens []struct {
+			ID      int  `json:"id"`
+			Special bool `json:"special"`
+		} `json:"added_tokens"`
+	}
+	if err := json.Unmarshal(tokenizerJSON, &tj); err != nil {
+		return nil, fmt.Errorf("failed to parse tokenizer vocabulary: %w", err)
+	}
+
+	size := 0
+	for _, id := range tj.Model.Vocab {
+		if id+1 > size {
+			size = id + 1
+		}
+	}
+	tokens := make([]string, size)
+	for token, id := range tj.Model.Vocab {
+		if id >= 0 {
+			tokens[id] = byteLevelDecode(token)
+		}
+	}
+	// 特殊 token 在解码时会被跳过，不影响 LaTeX 结构
+	for _, t := range tj.AddedTokens {
+		if t.Special && t.ID >= 0 && t.ID < size {
+			tokens[t.ID] = ""
+		}
+	}
+	return newLatexGrammarFromTokens(tokens), nil
+}
+
+// byteLevelUnicode 是 GPT-2 ByteLevel 编码中字符到原始字节的映射
+var byteLevelUnicode = func() map[rune]byte {
+	m := make(map[rune]byte, 256)
+	n := 0
+	for b := 0; b < 256; b++ {
+		if (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF) {
+			m[rune(b)] = byte(b)
+		} else {
+			m[rune(256+n)] = byte(b)
+			n++
+		}
+	}
+	return m
+}()
+
+func byteLevelDecode(token string) string {
+	out := make([]byte, 0, len(token))
+	for _, r := range token {
+		if b, ok := byteLevelUnicode[r]; ok {
+			out = append(out, b)
+		}
+	}
+	return string(out)
+}
+
+// mask 将在当前状态下会破坏 LaTeX 结构的 token 的 logit 设为 -Inf。
+// 如果所有 token 都会被屏蔽，则不做修改，避免解码无 token 可选。
+func (g *latexGrammar) mask(logits []float32, s *latexState, eos int64) {
+	banned := make([]bool, len(logits))
+	allowed := 0
+	// 不在命令名或环境名中间时，不含结构字符的 token 无需逐字符检查
+	plainOK := !s.inCmd && s.envMode == envNone
+	scratch := &latexState{}
+	for id := range logits {
+		ok := false
+		switch {
+		case int64(id) == eos:
+			ok = s.canEnd()
+		case id < len(g.tokens):
+			ok = plainOK && g.plain[id] || s.acceptsUsing(scratch, g.tokens[id])
+		}
+		if ok {
+			allowed++
+		} else {
+			banned[id] = true
+		}
+	}
+	if allowed == 0 {
+		return
+	}
+	for id, b := range banned {
+		if b {
+			logits[id] = float32(math.Inf(-1))
+		}
+	}
+}
+
+// advance 返回接受 token 后的新状态；token 不合法时返回 nil，之后不再约束该序列
+func (g *latexGrammar) advance(s *latexState, token int64) *latexState {
+	if s == nil || token < 0 || int(token) >= len(g.tokens) {
+		return nil
+	}
+	next := s.clone()
+	for i := 0; i < len(g.tokens[token]); i++ {
+		if !next.feed(g.tokens[token][i]) {
+			return nil
+		}
+	}
+	return next
+}
+
+type frameKind int
+
+const (
+	frameRoot  frameKind = iota
+	frameBrace           // { ... }
+	frameLeft            // \left ... \right
+	frameEnv             // \begin{env} ... \end{env}
+)
+
+// grammarFrame 是一层尚未闭合的结构
+type grammarFrame struct {
+	kind     frameKind
+	env      string
+	needArgs int // 本层中命令尚未得到的参数个数
+}
+
+type envMode int
+
+const (
+	envNone      envMode = iota
+	envOpenBegin         // \begin 之后等待 {
+	envOpenEnd           // \end 之后等待 {
+	envNameBegin         // 读取 \begin{...} 的环境名
+	envNameEnd           // 读取 \end{...} 的环境名
+)
+
+// latexState 是逐字符扫描已生成 LaTeX 的状态。命令名可能跨越多个 token，
+// 因此命令只在遇到第一个非字母字符（或结束）时才被处理。
+type latexState struct {
+	frames  []grammarFrame
+	inCmd   bool
+	cmd     []byte
+	envMode envMode
+	envName []byte
+}
+
+func newLatexState() *latexState {
+	return &latexState{frames: []grammarFrame{{kind: frameRoot}}}
+}
+
+func (s *latexState) clone() *latexState {
+	c := &latexState{}
+	c.copyFrom(s)
+	return c
+}
+
+// copyFrom 将 src 复制到 s，复用 s 已有的切片容量
+func (s *latexState) copyFrom(src *latexState) {
+	s.frames = append(s.frames[:0], src.frames...)
+	s.inCmd = src.inCmd
+	s.cmd = append(s.cmd[:0], src.cmd...)
+	s.envMode = src.envMode
+	s.envName = append(s.envName[:0], src.envName...)
+}
+
+func (s *latexState) top() *grammarFrame {
+	return &s.frames[len(s.frames)-1]
+}
+
+// accepts 判断在当前状态后追加文本是否仍然合法
+func (s *latexState) accepts(text string) bool {
+	return s.acceptsUsing(&latexState{}, text)
+}
+
+// acceptsUsing 与 accepts 相同，但在 scratch 上试探，逐个检查词表时可避免重复分配
+func (s *latexState) acceptsUsing(scratch *latexState, text string) bool {
+	if text == "" {
+		return true
+	}
+	scratch.copyFrom(s)
+	for i := 0; i < len(text); i++ {
+		if !scratch.feed(text[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// canEnd 判断是否可以在当前位置结束：所有结构都已闭合且命令参数齐全
+func (s *latexState) canEnd() bool {
+	c := s
+	if s.inCmd {
+		c = s.clone()
+		if len(c.cmd) == 0 || !c.finishCommand() {
+			return false
+		}
+	}
+	return c.envMode == envNone && len(c.frames) == 1 && c.frames[0].needArgs == 0
+}
+
+// atom 表示出现了一个完整的元素（字符、命令或分组），满足一个待定参数
+func (s *latexState) atom() bool {
+	if t := s.top(); t.needArgs > 0 {
+		t.needArgs--
+	}
+	return true
+}
+
+func (s *latexState) feed(c byte) bool {
+	if s.inCmd {
+		if isLetter(c) {
+			s.cmd = append(s.cmd, c)
+			return true
+		}
+		s.inCmd = false
+		if len(s.cmd) == 0 {
+			// 控制符号，例如 \{ \\ \,
+			return s.atom()
+		}
+		if !s.finishCommand() {
+			return false
+		}
+	}
+
+	switch s.envMode {
+	case envOpenBegin, envOpenEnd:
+		if c == ' ' {
+			return true
+		}
+		if c != '{' {
+			return false
+		}
+		s.envName = s.envName[:0]
+		if s.envMode == envOpenBegin {
+			s.envMode = envNameBegin
+		} else {
+			s.envMode = envNameEnd
+		}
+		return true
+	case envNameBegin:
+		if c == '}' {
+			if len(s.envName) == 0 {
+				return false
+			}
+			s.frames = append(s.frames, grammarFrame{kind: frameEnv, env: string(s.envName)})
+			s.envMode = envNone
+			return true
+		}
+		if !isLetter(c) && c != '*' {
+			return false
+		}
+		s.envName = append(s.envName, c)
+		return true
+	case envNameEnd:
+		expected := s.top().env
+		if c == '}' {
+			if string(s.envName) != expected {
+				return false
+			}
+			s.frames = s.frames[:len(s.frames)-1]
+			s.envMode = envNone
+			return true
+		}
+		if len(s.envName) >= len(expected) || expected[len(s.envName)] != c {
+			return false
+		}
+		s.envName = append(s.envName, c)
+		return true
+	}
+
+	switch c {
+	case '\\':
+		s.inCmd = true
+		s.cmd = s.cmd[:0]
+		return true
+	case '{':
+		s.atom()
+		s.frames = append(s.frames, grammarFrame{kind: frameBrace})
+		return true
+	case '}':
+		if t := s.top(); t.kind != frameBrace || t.needArgs > 0 {
+			return false
+		}
+		s.frames = s.frames[:len(s.frames)-1]
+		return true
+	case ' ':
+		return true
+	case '^', '_':
+		s.top().needArgs++
+		return true
+	default:
+		return s.atom()
+	}
+}
+
+// finishCommand 处理读取完毕的命令名
+func (s *latexState) finishCommand() bool {
+	name := string(s.cmd)
+	switch name {
+	case "left":
+		s.atom()
+		// \left 之后需要一个定界符
+		s.frames = append(s.frames, grammarFrame{kind: frameLeft, needArgs: 1})
+	case "right":
+		if t := s.top(); t.kind != frameLeft || t.needArgs > 0 {
+			return false
+		}
+		s.frames = s.frames[:len(s.frames)-1]
+		s.top().needArgs++ // \right 之后的定界符
+	case "begin":
+		s.atom()
+		s.envMode = envOpenBegin
+	case "end":
+		if t := s.top(); t.kind != frameEnv || t.needArgs > 0 {
+			return false
+		}
+		s.envMode = envOpenEnd
+	default:
+		s.atom()
+		s.top().needArgs += commandArgs[name]
+	}
+	return true
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,140 @@
+package model_controller
+
+import (
+	"math"
+	"testing"
+)
+
+// feedTokens 依次检查并接受 tokens，返回第一个被拒绝的 token 的下标（全部接受时为 -1）和最终状态
+func feedTokens(tokens []string) (int, *latexState) {
+	s := newLatexState()
+	for i, tok := range tokens {
+		if !s.accepts(tok) {
+			return i, s
+		}
+		for j := 0; j < len(tok); j++ {
+			s.feed(tok[j])
+		}
+	}
+	return -1, s
+}
+
+func TestLatexStateAcceptsAndCanEnd(t *testing.T) {
+	tests := []struct {
+		name     string
+		tokens   []string
+		rejected int  // 应被拒绝的 token 下标，-1 表示全部接受
+		canEnd   bool // 全部接受时能否结束
+	}{
+		{"balanced braces", []string{"{", "a", "{b}", "}"}, -1, true},
+		{"unclosed brace", []string{"{", "a"}, -1, false},
+		{"unmatched closing brace", []string{"a", "}"}, 1, false},
+		{"frac with two arguments", []string{`\frac{a}{b}`}, -1, true},
+		{"frac with one argument", []string{`\frac{a}`}, -1, false},
+		{"frac closes a brace before its second argument", []string{`{\frac{a}`, "}"}, 1, false},
+		{"left and right", []string{`\left(`, " x ", `\right)`}, -1, true},
+		{"left without right", []string{`\left(`, "x"}, -1, false},
+		{"lone right", []string{"x ", `\right)`}, 1, false},
+		{"matching environment", []string{`\begin{matrix}`, " a & b ", `\end{matrix}`}, -1, true},
+		{"unclosed environment", []string{`\begin{matrix}`, " a"}, -1, false},
+		{"mismatched environment", []string{`\begin{matrix}`, " a ", `\end{array}`}, 2, false},
+		{"superscript with argument", []string{"x", "^", "2"}, -1, true},
+		{"dangling superscript", []string{"x", "^"}, -1, false},
+		{"dangling subscript", []string{"x", "_"}, -1, false},
+		{"subscript closes a brace", []string{"{x", "_}"}, 1, false},
+		{"command split across tokens", []string{`\fr`, "ac", "{a}", "{b}"}, -1, true},
+		{"split command still needs its arguments", []string{`\fr`, "ac"}, -1, false},
+		{"split right without left", []string{`\rig`, "ht)"}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejected, s := feedTokens(tt.tokens)
+			if rejected != tt.rejected {
+				t.Fatalf("first rejected token = %d, want %d", rejected, tt.rejected)
+			}
+			if rejected == -1 && s.canEnd() != tt.canEnd {
+				t.Errorf("canEnd() = %v, want %v", s.canEnd(), tt.canEnd)
+			}
+		})
+	}
+}
+
+func TestLatexGrammarMask(t *testing.T) {
+	g := newLatexGrammarFromTokens([]string{"}", `\right)`, "a"})
+	const eos = 3
+	inf := float32(math.Inf(-1))
+
+	// 在根层级 } 与 \right 不合法，a 与结束符合法
+	logits := []float32{1, 2, 3, 4}
+	g.mask(logits, newLatexState(), eos)
+	want := []float32{inf, inf, 3, 4}
+	for i := range want {
+		if logits[i] != want[i] {
+			t.Errorf("logits = %v, want %v", logits, want)
+			break
+		}
+	}
+}
+
+// 所有 token 都不合法时 mask 不能把全部 logit 设为 -Inf
+func TestLatexGrammarMaskNeverBansEverything(t *testing.T) {
+	g := newLatexGrammarFromTokens([]string{"}", `\right)`, `\end{x}`})
+	const eos = 3
+	_, s := feedTokens([]string{"x", "^"})
+
+	logits := []float32{1, 2, 3, 4}
+	g.mask(logits, s, eos)
+	for i, v := range logits {
+		if math.IsInf(float64(v), -1) {
+			t.Fatalf("logits[%d] = -Inf, want every logit left unchanged: %v", i, logits)
+		}
+	}
+}
+
+// mask 对不含结构字符的 token 走快速路径，结果必须与逐个调用 accepts 一致
+func TestLatexGrammarMaskMatchesAccepts(t *testing.T) {
+	vocab := []string{"a", " x", "12", "}", "{", `\frac`, "ac", "ht)", "^", "_", " ", "matrix}", "b}", ")", `\right)`, `\end{matrix}`, "&"}
+	g := newLatexGrammarFromTokens(vocab)
+	eos := int64(len(vocab))
+	prefixes := map[string][]string{
+		"root":                {},
+		"inside brace":        {"{x"},
+		"pending superscript": {"x", "^"},
+		"inside command name": {`\rig`},
+		"inside left":         {`\left(`, "x"},
+		"environment name":    {`\begin{mat`},
+		"after end":           {`\begin{matrix}`, "a", `\end`},
+	}
+	for name, prefix := range prefixes {
+		t.Run(name, func(t *testing.T) {
+			rejected, s := feedTokens(prefix)
+			if rejected != -1 {
+				t.Fatalf("prefix %q rejected at %d", prefix, rejected)
+			}
+			logits := make([]float32, len(vocab)+1)
+			g.mask(logits, s, eos)
+			for id, tok := range vocab {
+				if masked := math.IsInf(float64(logits[id]), -1); masked == s.accepts(tok) {
+					t.Errorf("token %q: masked = %v, accepts = %v", tok, masked, !masked)
+				}
+			}
+		})
+	}
+}
+
+// 构造与真实词表规模相近的词表，衡量每步 mask 的开销
+func BenchmarkLatexGrammarMask(b *testing.B) {
+	base := []string{"a", "x", " ", "12", "+", "=", "{", "}", "^", "_", `\frac`, `\alpha`, `\left(`, `\right)`, `\begin{matrix}`, `\end{matrix}`, "&", `\\`, "ac", "pha"}
+	vocab := make([]string, 0, 1200)
+	for len(vocab) < cap(vocab) {
+		vocab = append(vocab, base...)
+	}
+	g := newLatexGrammarFromTokens(vocab[:1200])
+	_, s := feedTokens([]string{`\frac`, "{", "a", "}", "{", `\left(`, "x", "^"})
+	logits := make([]float32, 1201)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.mask(logits, s, 1200)
+	}
+}
@@ -0,0 +1,82 @@
+package model_controller
+
+import "math"
+
+// maxLoopPeriod 是循环检测中考虑的最长重复片段（token 数）
+const maxLoopPeriod = 8
+
+// processLogits 依次应用 repetition_penalty 与 no_repeat_ngram_size，原地修改 logits
+func (d *Decoder) processLogits(logits []float32, ids []int64) {
+	if d.config.RepetitionPenalty > 0 && d.config.RepetitionPenalty != 1 {
+		applyRepetitionPenalty(logits, ids, float32(d.config.RepetitionPenalty))
+	}
+	if d.config.NoRepeatNgramSize > 0 {
+		banRepeatedNgrams(logits, ids, d.config.NoRepeatNgramSize)
+	}
+}
+
+// applyRepetitionPenalty 与 transformers 的 RepetitionPenaltyLogitsProcessor 一致：
+// 已出现过的 token，logit 为正时除以 penalty，为负时乘以 penalty
+func applyRepetitionPenalty(logits []float32, ids []int64, penalty float32) {
+	seen := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] || id < 0 || int(id) >= len(logits) {
+			continue
+		}
+		seen[id] = true
+		if logits[id] > 0 {
+			logits[id] /= penalty
+		} else {
+			logits[id] *= penalty
+		}
+	}
+}
+
+// banRepeatedNgrams 与 transformers 的 NoRepeatNGramLogitsProcessor 一致：
+// 如果下一个 token 会使某个 n-gram 第二次出现，则将其 logit 设为 -Inf
+func banRepeatedNgrams(logits []float32, ids []int64, n int) {
+	if len(ids)+1 < n {
+		return
+	}
+	prefix := ids[len(ids)-n+1:] // 当前末尾的 n-1 个 token
+	for start := 0; start+n <= len(ids); start++ {
+		match := true
+		for i, id := range prefix {
+			if ids[start+i] != id {
+				match = false
+				break
+			}
+		}
+		if match {
+			if banned := ids[start+n-1]; banned >= 0 && int(banned) < len(logits) {
+				logits[banned] = float32(math.Inf(-1))
+			}
+		}
+	}
+}
+
+// detectLoop 判断序列末尾是否由长度不超过 maxLoopPeriod 的片段连续重复 repeats 次构成，
+// 例如 `\quad \quad \quad ...`。repeats <= 1 时不检测。
+func detectLoop(ids []int64, repeats int) bool {
+	if repeats <= 1 {
+		return false
+	}
+	for period := 1; period <= maxLoopPeriod; period++ {
+		span := period * repeats
+		if span > len(ids) {
+			break
+		}
+		tail := ids[len(ids)-span:]
+		loop := true
+		for i := period; i < span; i++ {
+			if tail[i] != tail[i-period] {
+				loop = false
+				break
+			}
+		}
+		if loop {
+			return true
+		}
+	}
+	return false
+}
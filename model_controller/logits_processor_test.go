@@ -0,0 +1,149 @@
+package model_controller
+
+import (
+	"math"
+	"testing"
+	"testing/fstest"
+)
+
+func TestApplyRepetitionPenalty(t *testing.T) {
+	tests := []struct {
+		name    string
+		logits  []float32
+		ids     []int64
+		penalty float32
+		want    []float32
+	}{
+		{"positive logit is divided", []float32{2, 3}, []int64{0}, 2, []float32{1, 3}},
+		{"negative logit is multiplied", []float32{-2, 3}, []int64{0}, 2, []float32{-4, 3}},
+		{"zero logit is unchanged", []float32{0, 3}, []int64{0}, 2, []float32{0, 3}},
+		{"repeated id is penalized once", []float32{4, -1}, []int64{0, 1, 0, 0}, 2, []float32{2, -2}},
+		{"penalty below one favours repetition", []float32{2, -2}, []int64{0, 1}, 0.5, []float32{4, -1}},
+		{"out of range ids are ignored", []float32{2, 2}, []int64{-1, 5}, 2, []float32{2, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applyRepetitionPenalty(tt.logits, tt.ids, tt.penalty)
+			for i := range tt.want {
+				if tt.logits[i] != tt.want[i] {
+					t.Fatalf("logits = %v, want %v", tt.logits, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBanRepeatedNgrams(t *testing.T) {
+	tests := []struct {
+		name   string
+		ids    []int64
+		n      int
+		banned []int64
+	}{
+		{"too short for an n-gram", []int64{1}, 3, nil},
+		{"exactly n-1 tokens", []int64{1, 2}, 3, nil},
+		{"bigram repeated", []int64{5, 6, 5}, 2, []int64{6}},
+		{"trigram at the start", []int64{1, 2, 3, 1, 2}, 3, []int64{3}},
+		{"trigram ending at the last token", []int64{4, 1, 2, 1, 2}, 3, []int64{1}},
+		{"prefix seen with different continuations", []int64{1, 2, 1, 3, 1}, 2, []int64{2, 3}},
+		{"no matching prefix", []int64{1, 2, 3, 4}, 3, nil},
+		{"unigram bans every seen token", []int64{0, 2}, 1, []int64{0, 2}},
+		{"out of range continuation", []int64{1, 9, 1}, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logits := make([]float32, 8)
+			banRepeatedNgrams(logits, tt.ids, tt.n)
+			want := make([]bool, len(logits))
+			for _, id := range tt.banned {
+				want[id] = true
+			}
+			for id, v := range logits {
+				if got := math.IsInf(float64(v), -1); got != want[id] {
+					t.Errorf("token %d banned = %v, want %v", id, got, want[id])
+				}
+			}
+		})
+	}
+}
+
+// repeatIDs 返回 prefix 之后 unit 重复 n 次的序列
+func repeatIDs(prefix, unit []int64, n int) []int64 {
+	ids := append([]int64(nil), prefix...)
+	for i := 0; i < n; i++ {
+		ids = append(ids, unit...)
+	}
+	return ids
+}
+
+func TestDetectLoop(t *testing.T) {
+	period8 := []int64{10, 11, 12, 13, 14, 15, 16, 17}
+	nonLoop := make([]int64, 100)
+	for i := range nonLoop {
+		nonLoop[i] = int64(i % 37)
+	}
+	brokenLoop := repeatIDs(nil, period8, 12)
+	brokenLoop[len(brokenLoop)-3] = 99
+
+	tests := []struct {
+		name    string
+		ids     []int64
+		repeats int
+		want    bool
+	}{
+		{"period 1", repeatIDs([]int64{1, 2, 3}, []int64{7}, 12), 12, true},
+		{"period 1 one repeat short", repeatIDs([]int64{1, 2, 3}, []int64{7}, 11), 12, false},
+		{"period 8", repeatIDs([]int64{1, 2, 3}, period8, 12), 12, true},
+		{"period 8 one repeat short", repeatIDs([]int64{1, 2, 3}, period8, 11), 12, false},
+		{"period 9 is too long", repeatIDs(nil, append(period8, 18), 12), 12, false},
+		{"not a loop", nonLoop, 12, false},
+		{"loop broken near the end", brokenLoop, 12, false},
+		{"detection disabled", repeatIDs(nil, []int64{7}, 20), 0, false},
+		{"shorter than the repeat count", []int64{7, 7}, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectLoop(tt.ids, tt.repeats); got != tt.want {
+				t.Errorf("detectLoop(%d ids, %d) = %v, want %v", len(tt.ids), tt.repeats, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDecoderConfigLoopRepeats(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		want    int
+		wantErr bool
+	}{
+		{"default", fstest.MapFS{}, 12, false},
+		{"config.json", fstest.MapFS{
+			ConfigFile: {Data: []byte(`{"decoder": {"loop_repeats": 6}}`)},
+		}, 6, false},
+		{"generation_config.json takes precedence", fstest.MapFS{
+			ConfigFile:           {Data: []byte(`{"decoder": {"loop_repeats": 6}}`)},
+			GenerationConfigFile: {Data: []byte(`{"loop_repeats": 0}`)},
+		}, 0, false},
+		{"negative", fstest.MapFS{
+			GenerationConfigFile: {Data: []byte(`{"loop_repeats": -1}`)},
+		}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadDecoderConfig(tt.fsys)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadDecoderConfig succeeded with LoopRepeats %d, want an error", config.LoopRepeats)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.LoopRepeats != tt.want {
+				t.Errorf("LoopRepeats = %d, want %d", config.LoopRepeats, tt.want)
+			}
+		})
+	}
+}
@@ -1,65 +1,546 @@
 package model_controller
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/disintegration/imaging"
 	"github.com/nfnt/resize"
 	"image"
+	"image/color"
 	"image/draw"
 	"io"
+	"io/fs"
+	"math"
+	"sort"
 )
 
-// PreprocessToModelFormat 输入图像路径，返回符合 TrOCR 模型的张量（[1,3,384,384]）和形状信息
-// 输出格式：数据为 []float32（CHW 顺序），形状为 []int64{1, 3, 384, 384}
-func PreprocessToModelFormat(file io.Reader) ([]float32, []int64, error) {
-	img, err := imaging.Decode(file)
+// ImageSize 对应 preprocessor_config.json 中的 size / crop_size
+type ImageSize struct {
+	Height       int `json:"height"`
+	Width        int `json:"width"`
+	ShortestEdge int `json:"shortest_edge"` // 部分 image processor 只给出最短边
+}
+
+// PreprocessorConfig 对应 preprocessor_config.json（transformers 的 image processor 配置）
+type PreprocessorConfig struct {
+	DoResize      bool          `json:"do_resize"`
+	Size          ImageSize     `json:"size"`
+	Resample      int           `json:"resample"` // PIL 插值方式：0 nearest, 1 lanczos, 2 bilinear, 3 bicubic, 4 box, 5 hamming
+	DoCenterCrop  bool          `json:"do_center_crop"`
+	CropSize      ImageSize     `json:"crop_size"`
+	DoRescale     bool          `json:"do_rescale"`
+	RescaleFactor float64       `json:"rescale_factor"`
+	DoNormalize   bool          `json:"do_normalize"`
+	ImageMean     ChannelValues `json:"image_mean"`
+	ImageStd      ChannelValues `json:"image_std"`
+}
+
+// ChannelValues 是每个通道一个值（3 个）或所有通道共用的一个值，JSON 中可以写成数组或单个数字
+type ChannelValues []float64
+
+func (v *ChannelValues) UnmarshalJSON(data []byte) error {
+	var scalar float64
+	if err := json.Unmarshal(data, &scalar); err == nil {
+		*v = ChannelValues{scalar}
+		return nil
+	}
+	var values []float64
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*v = values
+	return nil
+}
+
+// DefaultPreprocessorConfig 返回 pix2text-mfr 模型的预处理配置
+func DefaultPreprocessorConfig() *PreprocessorConfig {
+	return &PreprocessorConfig{
+		DoResize:      true,
+		Size:          ImageSize{Height: 384, Width: 384},
+		Resample:      3,
+		DoCenterCrop:  false,
+		CropSize:      ImageSize{Height: 224, Width: 224},
+		DoRescale:     true,
+		RescaleFactor: 1.0 / 255.0,
+		DoNormalize:   true,
+		ImageMean:     ChannelValues{0.5, 0.5, 0.5},
+		ImageStd:      ChannelValues{0.5, 0.5, 0.5},
+	}
+}
 
+// LoadPreprocessorConfig 读取模型目录中的 preprocessor_config.json，文件或字段缺失时保留默认值。
+// size 与 crop_size 整体替换默认值，因此只给出 shortest_edge 的配置不会沿用默认的 384×384。
+func LoadPreprocessorConfig(fsys fs.FS) (*PreprocessorConfig, error) {
+	config := DefaultPreprocessorConfig()
+	defaultSize, defaultCropSize := config.Size, config.CropSize
+	config.Size, config.CropSize = ImageSize{}, ImageSize{}
+	if _, err := readJSONFile(fsys, PreprocessorConfigFile, config); err != nil {
+		return nil, err
+	}
+	if config.Size == (ImageSize{}) {
+		config.Size = defaultSize
+	}
+	if config.CropSize == (ImageSize{}) {
+		config.CropSize = defaultCropSize
+	}
+	return config, nil
+}
+
+// ResizeMode 决定图像如何缩放到模型输入尺寸
+type ResizeMode string
+
+const (
+	ResizeStretch   ResizeMode = "stretch"   // 直接拉伸到目标尺寸（默认，与训练时的预处理一致）
+	ResizeLetterbox ResizeMode = "letterbox" // 保持宽高比缩放，空白部分用背景色填充
+)
+
+// PreprocessOptions 是模型配置之外、由应用选择的预处理选项，零值表示与模型原始预处理一致
+type PreprocessOptions struct {
+	ResizeMode ResizeMode // 为空时等同于 ResizeStretch
+
+	// Background 是透明图像合成时使用的背景色，为 nil 时使用白色
+	Background color.Color
+
+	// AutoInvert 在背景偏暗（浅色文字、深色背景）时反色，使图像变为深色文字、浅色背景
+	AutoInvert bool
+	// Grayscale 将图像转换为灰度
+	Grayscale bool
+	// NormalizeBackground 估计背景色并将其映射为白色，墨迹按与背景的差异映射为深色
+	NormalizeBackground bool
+
+	// Deskew 根据墨迹分布估计倾斜角度（不超过 maxSkewAngle）并将图像旋转至水平
+	Deskew bool
+
+	// Trim 在缩放前裁剪到墨迹的外接矩形，并在四周留出 TrimMargin 像素的背景色边距
+	Trim       bool
+	TrimMargin int
+}
+
+// PreprocessedImage 是预处理的结果
+type PreprocessedImage struct {
+	Data  []float32 // CHW 顺序的模型输入
+	Shape []int64   // [1, 3, H, W]
+	// CropRect 是裁剪时保留的区域（包含边距）；未裁剪时为整张图。
+	// 坐标为原图坐标，若图像经过 deskew 旋转则为旋转后图像的坐标
+	CropRect image.Rectangle
+	// Inverted 表示图像因背景偏暗而被反色
+	Inverted bool
+	// SkewAngle 是校正时反向旋转的倾斜角度（度），正值表示文字向右上方倾斜（逆时针）；
+	// 未启用 Deskew 或角度小于 minDeskewAngle 而未旋转时为 0
+	SkewAngle float64
+}
+
+// Validate 检查选项是否合法
+func (o PreprocessOptions) Validate() error {
+	switch o.ResizeMode {
+	case "", ResizeStretch, ResizeLetterbox:
+	default:
+		return fmt.Errorf("unsupported resize mode %q", o.ResizeMode)
+	}
+	if o.TrimMargin < 0 {
+		return fmt.Errorf("trim margin must not be negative, got %d", o.TrimMargin)
+	}
+	return nil
+}
+
+// Preprocessor 按照 PreprocessorConfig 将图像转换为模型输入张量
+type Preprocessor struct {
+	config    PreprocessorConfig
+	options   PreprocessOptions
+	mean, std [3]float32
+}
+
+// NewPreprocessor 校验配置并创建 Preprocessor，config 为 nil 时使用默认配置
+func NewPreprocessor(config *PreprocessorConfig, options PreprocessOptions) (*Preprocessor, error) {
+	if config == nil {
+		config = DefaultPreprocessorConfig()
+	}
+	p := &Preprocessor{config: *config, options: options}
+
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.DoResize && config.Size.ShortestEdge <= 0 && (config.Size.Height <= 0 || config.Size.Width <= 0) {
+		return nil, fmt.Errorf("invalid resize size %+v", config.Size)
+	}
+	if config.DoCenterCrop && (config.CropSize.Height <= 0 || config.CropSize.Width <= 0) {
+		return nil, fmt.Errorf("invalid crop size %+v", config.CropSize)
+	}
+	if config.Resample < 0 || config.Resample > 5 {
+		return nil, fmt.Errorf("unsupported resample filter %d", config.Resample)
+	}
+
+	// 均值与标准差可以是每个通道一个值，也可以是所有通道共用一个值
+	for c := 0; c < 3; c++ {
+		p.mean[c], p.std[c] = 0, 1
+		if config.DoNormalize {
+			mean, err := channelValue(config.ImageMean, c, "image_mean")
+			if err != nil {
+				return nil, err
+			}
+			std, err := channelValue(config.ImageStd, c, "image_std")
+			if err != nil {
+				return nil, err
+			}
+			if std == 0 {
+				return nil, fmt.Errorf("image_std must not be zero")
+			}
+			p.mean[c], p.std[c] = float32(mean), float32(std)
+		}
+	}
+	return p, nil
+}
+
+func channelValue(values ChannelValues, c int, name string) (float64, error) {
+	switch len(values) {
+	case 1:
+		return values[0], nil
+	case 3:
+		return values[c], nil
+	default:
+		return 0, fmt.Errorf("%s must have 1 or 3 values, got %d", name, len(values))
+	}
+}
+
+// Process 解码图像并返回模型输入张量（CHW 顺序的 []float32）及其形状 [1, 3, H, W]
+func (p *Preprocessor) Process(file io.Reader) ([]float32, []int64, error) {
+	img, err := p.Run(file)
 	if err != nil {
 		return nil, nil, err
 	}
+	return img.Data, img.Shape, nil
+}
+
+// Run 与 Process 相同，但同时返回预处理过程的信息
+func (p *Preprocessor) Run(file io.Reader) (*PreprocessedImage, error) {
+	img, err := imaging.Decode(file)
+
+	if err != nil {
+		return nil, err
+	}
 
-	// 2. 转换为 RGBA 格式（兼容所有输入类型）
-	rgba := toRGBA(img)
+	// 合成到不透明背景上并转换为 RGBA 格式（兼容所有输入类型）
+	background := p.options.Background
+	if background == nil {
+		background = color.White
+	}
+	rgba := toRGBA(img, background)
+	result := &PreprocessedImage{CropRect: rgba.Bounds()}
 
-	// 3. Resize 到 384x384（使用 Bicubic 插值，对应配置的 resample=3）
-	targetW, targetH := 384, 384
-	resized := resize.Resize(uint(targetW), uint(targetH), rgba, resize.Bicubic) // 重要：对齐配置的 resample=3
+	// 颜色归一化：反色 → 灰度 → 背景归一化
+	if p.options.AutoInvert && luminance(borderColor(rgba)) < 128 {
+		invert(rgba)
+		result.Inverted = true
+	}
+	if p.options.Grayscale {
+		grayscale(rgba)
+	}
+	if p.options.NormalizeBackground {
+		normalizeBackground(rgba, borderColor(rgba))
+	}
 
-	// 4. 预处理：Rescale → Normalize
-	tensor := make([]float32, 3*targetH*targetW) // CHW 顺序 [3, 384, 384]
+	// 倾斜校正
+	if p.options.Deskew {
+		bg := borderColor(rgba)
+		if angle := estimateSkew(rgba, bg); math.Abs(angle) >= minDeskewAngle {
+			// imaging.Rotate 按逆时针旋转，这里反向旋转检测到的角度
+			rgba = toRGBA(imaging.Rotate(rgba, -angle, bg), bg)
+			result.SkewAngle = angle
+		}
+	}
+
+	// 裁剪空白边缘
+	if p.options.Trim {
+		rgba, result.CropRect = trimToInk(rgba, p.options.TrimMargin)
+	}
+	var processed image.Image = rgba
+
+	// Resize（默认 Bicubic 插值，对应配置的 resample=3）
+	if p.config.DoResize {
+		w, h := p.targetSize(processed.Bounds())
+		if p.options.ResizeMode == ResizeLetterbox {
+			processed = letterbox(processed, w, h, p.config.Resample)
+		} else {
+			processed = resizeImage(processed, w, h, p.config.Resample)
+		}
+	}
+
+	// Center crop
+	if p.config.DoCenterCrop {
+		processed = imaging.CropCenter(processed, p.config.CropSize.Width, p.config.CropSize.Height)
+	}
+
+	// 预处理：Rescale → Normalize
+	bounds := processed.Bounds()
+	targetW, targetH := bounds.Dx(), bounds.Dy()
+	tensor := make([]float32, 3*targetH*targetW) // CHW 顺序 [3, H, W]
+
+	rescale := float32(1)
+	if p.config.DoRescale {
+		rescale = float32(p.config.RescaleFactor)
+	}
 
 	for y := 0; y < targetH; y++ {
 		for x := 0; x < targetW; x++ {
 			// 获取像素值（0-255）
-			r, g, b, _ := resized.At(x, y).RGBA()
-			rr, rg, rb := float32(r>>8), float32(g>>8), float32(b>>8)
-
-			// Rescale: [0, 255] → [0, 1] (配置的 rescale_factor=1/255)
-			rr /= 255.0
-			rg /= 255.0
-			rb /= 255.0
-
-			// Normalize: (x - mean) / std (配置的 mean=0.5, std=0.5 → 最终范围 [-1, 1])
-			rr = (rr - 0.5) / 0.5
-			rg = (rg - 0.5) / 0.5
-			rb = (rb - 0.5) / 0.5
-
-			// 按 CHW 顺序填充数据
-			// R通道: 0*H*W + y*W + x
-			// G通道: 1*H*W + y*W + x
-			// B通道: 2*H*W + y*W + x
-			tensor[y*targetW+x] = rr                   // R
-			tensor[targetH*targetW+y*targetW+x] = rg   // G
-			tensor[2*targetH*targetW+y*targetW+x] = rb // B
+			r, g, b, _ := processed.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pixel := [3]float32{float32(r >> 8), float32(g >> 8), float32(b >> 8)}
+
+			for c := 0; c < 3; c++ {
+				// Rescale: [0, 255] → [0, 1]；Normalize: (x - mean) / std
+				v := (pixel[c]*rescale - p.mean[c]) / p.std[c]
+				// 按 CHW 顺序填充数据：c*H*W + y*W + x
+				tensor[c*targetH*targetW+y*targetW+x] = v
+			}
+		}
+	}
+
+	result.Data = tensor
+	result.Shape = []int64{1, 3, int64(targetH), int64(targetW)}
+	return result, nil
+}
+
+// targetSize 计算 resize 后的尺寸；只给出最短边时保持宽高比
+func (p *Preprocessor) targetSize(bounds image.Rectangle) (int, int) {
+	size := p.config.Size
+	if size.Height > 0 && size.Width > 0 {
+		return size.Width, size.Height
+	}
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= h {
+		return size.ShortestEdge, h * size.ShortestEdge / w
+	}
+	return w * size.ShortestEdge / h, size.ShortestEdge
+}
+
+// resizeImage 按照 PIL 的 resample 编号选择插值方式
+func resizeImage(img image.Image, w, h, resample int) image.Image {
+	switch resample {
+	case 0:
+		return resize.Resize(uint(w), uint(h), img, resize.NearestNeighbor)
+	case 1:
+		return resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+	case 2:
+		return resize.Resize(uint(w), uint(h), img, resize.Bilinear)
+	case 4:
+		return imaging.Resize(img, w, h, imaging.Box)
+	case 5:
+		return imaging.Resize(img, w, h, imaging.Hamming)
+	default:
+		return resize.Resize(uint(w), uint(h), img, resize.Bicubic)
+	}
+}
+
+// letterbox 保持宽高比将图像缩放到 w×h 之内并居中，四周用估计的背景色填充
+func letterbox(img image.Image, w, h, resample int) image.Image {
+	bounds := img.Bounds()
+	scale := math.Min(float64(w)/float64(bounds.Dx()), float64(h)/float64(bounds.Dy()))
+	scaledW := max(1, int(math.Round(float64(bounds.Dx())*scale)))
+	scaledH := max(1, int(math.Round(float64(bounds.Dy())*scale)))
+	scaled := resizeImage(img, scaledW, scaledH, resample)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(borderColor(img)), image.Point{}, draw.Src)
+	offset := image.Pt((w-scaledW)/2, (h-scaledH)/2)
+	draw.Draw(canvas, image.Rectangle{Min: offset, Max: offset.Add(image.Pt(scaledW, scaledH))}, scaled, scaled.Bounds().Min, draw.Src)
+	return canvas
+}
+
+// borderColor 以边缘像素各通道的中位数估计背景色
+func borderColor(img image.Image) color.RGBA {
+	b := img.Bounds()
+	var rs, gs, bs []uint8
+	add := func(x, y int) {
+		c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+		rs, gs, bs = append(rs, c.R), append(gs, c.G), append(bs, c.B)
+	}
+	for x := b.Min.X; x < b.Max.X; x++ {
+		add(x, b.Min.Y)
+		add(x, b.Max.Y-1)
+	}
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y++ {
+		add(b.Min.X, y)
+		add(b.Max.X-1, y)
+	}
+	return color.RGBA{R: median(rs), G: median(gs), B: median(bs), A: 0xff}
+}
+
+func median(values []uint8) uint8 {
+	if len(values) == 0 {
+		return 0xff
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values[len(values)/2]
+}
+
+// inkThreshold 是像素与背景色的最大通道差超过多少时视为墨迹
+const inkThreshold = 48
+
+// inkBounds 返回与背景色明显不同的像素的外接矩形，没有墨迹时 ok 为 false
+func inkBounds(img *image.RGBA, bg color.RGBA) (rect image.Rectangle, ok bool) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := (x - b.Min.X) * 4
+			if channelDiff(row[i], bg.R) <= inkThreshold && channelDiff(row[i+1], bg.G) <= inkThreshold && channelDiff(row[i+2], bg.B) <= inkThreshold {
+				continue
+			}
+			pixel := image.Rect(x, y, x+1, y+1)
+			if ok {
+				rect = rect.Union(pixel)
+			} else {
+				rect, ok = pixel, true
+			}
+		}
+	}
+	return rect, ok
+}
+
+func channelDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// trimToInk 裁剪到墨迹的外接矩形，并在四周留出 margin 像素的背景色边距（超出原图的部分用背景色填充）。
+// 返回裁剪后的图像（原点为 (0,0)）及保留的区域（img 的坐标，已截取到 img 范围内）；没有墨迹时返回原图。
+func trimToInk(img *image.RGBA, margin int) (*image.RGBA, image.Rectangle) {
+	bg := borderColor(img)
+	ink, ok := inkBounds(img, bg)
+	if !ok {
+		return img, img.Bounds()
+	}
+	crop := ink.Inset(-margin)
+	out := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(out, out.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	kept := crop.Intersect(img.Bounds())
+	draw.Draw(out, kept.Sub(crop.Min), img, kept.Min, draw.Src)
+	return out, kept
+}
+
+// luminance 返回 ITU-R BT.601 亮度（0-255）
+func luminance(c color.RGBA) uint8 {
+	return uint8((299*int(c.R) + 587*int(c.G) + 114*int(c.B) + 500) / 1000)
+}
+
+// invert 对图像的 RGB 通道反色
+func invert(img *image.RGBA) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		img.Pix[i] = 255 - img.Pix[i]
+		img.Pix[i+1] = 255 - img.Pix[i+1]
+		img.Pix[i+2] = 255 - img.Pix[i+2]
+	}
+}
+
+// grayscale 将每个像素的 RGB 通道替换为其亮度
+func grayscale(img *image.RGBA) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		y := luminance(color.RGBA{R: img.Pix[i], G: img.Pix[i+1], B: img.Pix[i+2]})
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = y, y, y
+	}
+}
+
+// normalizeBackground 将背景色映射为白色：每个像素按与背景色的最大通道差映射为灰度，
+// 差异越大越黑，差异为可能的最大值时为黑色。这样彩色背景上任意颜色的墨迹都变为白底深色文字。
+func normalizeBackground(img *image.RGBA, bg color.RGBA) {
+	maxDiff := 0
+	for _, c := range []uint8{bg.R, bg.G, bg.B} {
+		maxDiff = max(maxDiff, int(c), 255-int(c))
+	}
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		d := max(channelDiff(img.Pix[i], bg.R), channelDiff(img.Pix[i+1], bg.G), channelDiff(img.Pix[i+2], bg.B))
+		y := uint8(255 - d*255/maxDiff)
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = y, y, y
+	}
+}
+
+const (
+	maxSkewAngle   = 10.0  // 搜索的最大倾斜角度（度）
+	minDeskewAngle = 0.3   // 小于该角度时不旋转，避免插值带来的模糊
+	maxSkewSamples = 20000 // 估计倾斜角度时最多使用的墨迹像素数
+)
+
+// estimateSkew 用投影轮廓法估计倾斜角度（度）：将墨迹像素按候选角度投影到竖直方向，
+// 文字行与分数线对齐时投影最集中，即各行像素数的平方和最大。先以 1° 为步长粗搜索，再以 0.1° 细化。
+func estimateSkew(img *image.RGBA, bg color.RGBA) float64 {
+	b := img.Bounds()
+	// 第一遍只统计墨迹像素数，第二遍按固定间隔取样，内存不超过 maxSkewSamples 个点
+	scan := func(visit func(x, y int)) {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(b.Min.X, y):]
+			for x := b.Min.X; x < b.Max.X; x++ {
+				i := (x - b.Min.X) * 4
+				if channelDiff(row[i], bg.R) > inkThreshold || channelDiff(row[i+1], bg.G) > inkThreshold || channelDiff(row[i+2], bg.B) > inkThreshold {
+					visit(x-b.Min.X, y-b.Min.Y)
+				}
+			}
 		}
 	}
+	ink := 0
+	scan(func(x, y int) { ink++ })
+	if ink < 2 {
+		return 0
+	}
+	step := (ink + maxSkewSamples - 1) / maxSkewSamples
+	points := make([]image.Point, 0, (ink+step-1)/step)
+	n := 0
+	scan(func(x, y int) {
+		if n%step == 0 {
+			points = append(points, image.Pt(x, y))
+		}
+		n++
+	})
 
-	return tensor, []int64{1, 3, int64(targetH), int64(targetW)}, nil
+	diagonal := int(math.Hypot(float64(b.Dx()), float64(b.Dy()))) + 1
+	bins := make([]int, 2*diagonal+1)
+	score := func(angle float64) float64 {
+		sin, cos := math.Sincos(angle * math.Pi / 180)
+		clear(bins)
+		for _, pt := range points {
+			// 向右上方倾斜 angle 度的直线上各点的投影相同
+			bins[diagonal+int(math.Round(float64(pt.Y)*cos+float64(pt.X)*sin))]++
+		}
+		var sum float64
+		for _, n := range bins {
+			sum += float64(n) * float64(n)
+		}
+		return sum
+	}
+
+	best, bestScore := 0.0, score(0)
+	search := func(from, to, step float64) {
+		for angle := from; angle <= to+step/2; angle += step {
+			if s := score(angle); s > bestScore {
+				best, bestScore = angle, s
+			}
+		}
+	}
+	search(-maxSkewAngle, maxSkewAngle, 1)
+	search(max(best-1, -maxSkewAngle), min(best+1, maxSkewAngle), 0.1)
+	return math.Round(best*10) / 10
+}
+
+// PreprocessToModelFormat 使用默认配置预处理图像，返回符合 TrOCR 模型的张量（[1,3,384,384]）和形状信息
+// 输出格式：数据为 []float32（CHW 顺序），形状为 []int64{1, 3, 384, 384}
+func PreprocessToModelFormat(file io.Reader) ([]float32, []int64, error) {
+	p, err := NewPreprocessor(nil, PreprocessOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Process(file)
 }
 
-// toRGBA 将任意图像转换为 RGBA 格式
-func toRGBA(src image.Image) *image.RGBA {
+// toRGBA 将任意图像按 alpha 合成到不透明的背景色上，返回完全不透明的 RGBA 图像。
+// 直接复制像素会把透明像素变成 (0,0,0,0)，丢弃 alpha 后透明背景就成了黑色。
+func toRGBA(src image.Image, background color.Color) *image.RGBA {
 	bounds := src.Bounds()
 	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, src, bounds.Min, draw.Src)
+	opaque := color.NRGBAModel.Convert(background).(color.NRGBA)
+	opaque.A = 0xff // 背景色自身的透明度被忽略
+	draw.Draw(rgba, bounds, image.NewUniform(opaque), image.Point{}, draw.Src)
+	draw.Draw(rgba, bounds, src, bounds.Min, draw.Over)
 	return rgba
 }
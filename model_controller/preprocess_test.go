@@ -0,0 +1,528 @@
+package model_controller
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/disintegration/imaging"
+)
+
+// testdata 中的透明图像（64×32）：
+//   - transparent_glyph.png：完全透明的背景上，(24,8)-(40,24) 为不透明黑色方块
+//   - semitransparent_glyph.png：完全透明的背景上，(8,8)-(32,24) 为 50% 透明度的黑色，(32,8)-(56,24) 为不透明黑色
+//   - transparent_palette.png：与 transparent_glyph.png 相同，但为调色板图像，透明度来自 tRNS
+//   - light_on_dark.png：(20,20,40) 的深色背景上，(24,8)-(40,24) 为 (240,240,240) 的浅色方块
+//   - colored_background.png：(255,240,160) 的浅黄色背景上，(24,8)-(40,24) 为 (40,60,200) 的蓝色方块
+const (
+	fixtureWidth  = 64
+	fixtureHeight = 32
+)
+
+// unscaledPreprocessor 不缩放图像，以便按原图坐标检查张量中的像素值。
+// 归一化后 -1 为黑色，1 为白色。
+func unscaledPreprocessor(t *testing.T, options PreprocessOptions) *Preprocessor {
+	t.Helper()
+	config := DefaultPreprocessorConfig()
+	config.DoResize = false
+	p, err := NewPreprocessor(config, options)
+	if err != nil {
+		t.Fatalf("NewPreprocessor: %v", err)
+	}
+	return p
+}
+
+// fixtureSizePreprocessor 将图像缩放到 64×32，裁剪后的张量形状仍与原图一致
+func fixtureSizePreprocessor(t *testing.T, options PreprocessOptions) *Preprocessor {
+	t.Helper()
+	config := DefaultPreprocessorConfig()
+	config.Size = ImageSize{Height: fixtureHeight, Width: fixtureWidth}
+	p, err := NewPreprocessor(config, options)
+	if err != nil {
+		t.Fatalf("NewPreprocessor: %v", err)
+	}
+	return p
+}
+
+func processFixture(t *testing.T, p *Preprocessor, name string) *PreprocessedImage {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := p.Run(f)
+	if err != nil {
+		t.Fatalf("Run(%s): %v", name, err)
+	}
+	want := []int64{1, 3, fixtureHeight, fixtureWidth}
+	for i := range want {
+		if img.Shape[i] != want[i] {
+			t.Fatalf("Run(%s) shape = %v, want %v", name, img.Shape, want)
+		}
+	}
+	return img
+}
+
+// checkPixel 检查 (x, y) 处三个通道的归一化值
+func checkPixel(t *testing.T, img *PreprocessedImage, x, y int, want [3]float32) {
+	t.Helper()
+	h, w := int(img.Shape[2]), int(img.Shape[3])
+	for c := 0; c < 3; c++ {
+		got := img.Data[c*h*w+y*w+x]
+		if math.Abs(float64(got-want[c])) > 0.02 {
+			t.Errorf("pixel (%d,%d) channel %d = %.3f, want %.3f", x, y, c, got, want[c])
+		}
+	}
+}
+
+var (
+	white = [3]float32{1, 1, 1}
+	black = [3]float32{-1, -1, -1}
+	gray  = [3]float32{0, 0, 0}
+)
+
+func TestProcessCompositesTransparencyOntoWhite(t *testing.T) {
+	p := unscaledPreprocessor(t, PreprocessOptions{})
+	for _, name := range []string{"transparent_glyph.png", "transparent_palette.png"} {
+		t.Run(name, func(t *testing.T) {
+			img := processFixture(t, p, name)
+			checkPixel(t, img, 0, 0, white)
+			checkPixel(t, img, 63, 31, white)
+			checkPixel(t, img, 30, 15, black)
+		})
+	}
+}
+
+func TestProcessCompositesSemiTransparentPixels(t *testing.T) {
+	img := processFixture(t, unscaledPreprocessor(t, PreprocessOptions{}), "semitransparent_glyph.png")
+	checkPixel(t, img, 2, 2, white)
+	checkPixel(t, img, 16, 15, gray) // 50% 黑色叠加在白色上为中灰
+	checkPixel(t, img, 48, 15, black)
+}
+
+func TestProcessCompositesOntoConfiguredBackground(t *testing.T) {
+	options := PreprocessOptions{Background: color.RGBA{R: 255, G: 0, B: 0, A: 255}}
+	img := processFixture(t, unscaledPreprocessor(t, options), "transparent_glyph.png")
+	checkPixel(t, img, 0, 0, [3]float32{1, -1, -1})
+	checkPixel(t, img, 30, 15, black)
+}
+
+func TestProcessTransparentImageCanBeTrimmed(t *testing.T) {
+	// 合成之前透明背景与黑色墨迹无法区分，裁剪会保留整张图
+	options := PreprocessOptions{Trim: true, TrimMargin: 2}
+	img := processFixture(t, fixtureSizePreprocessor(t, options), "transparent_glyph.png")
+	want := image.Rect(22, 6, 42, 26)
+	if img.CropRect != want {
+		t.Errorf("CropRect = %v, want %v", img.CropRect, want)
+	}
+}
+
+func TestToRGBAIsOpaque(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(1, 0, color.NRGBA{R: 0, G: 0, B: 255, A: 64})
+	dst := toRGBA(src, color.White)
+	if got := dst.RGBAAt(0, 0); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("transparent pixel = %v, want opaque white", got)
+	}
+	if got := dst.RGBAAt(1, 0); got.A != 255 || got.B != 255 || got.R < 180 || got.R > 200 {
+		t.Errorf("25%% blue pixel = %v, want opaque light blue", got)
+	}
+}
+
+func TestEstimateSkew(t *testing.T) {
+	// 两行“文字”和一条分数线
+	formula := image.NewRGBA(image.Rect(0, 0, 300, 120))
+	draw := func(r image.Rectangle) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				formula.SetRGBA(x, y, color.RGBA{A: 255})
+			}
+		}
+	}
+	for i := range formula.Pix {
+		formula.Pix[i] = 255
+	}
+	draw(image.Rect(40, 58, 260, 60))
+	for x := 60; x < 240; x += 12 {
+		draw(image.Rect(x, 35, x+6, 47))
+		draw(image.Rect(x+3, 70, x+9, 82))
+	}
+
+	bg := color.RGBA{255, 255, 255, 255}
+	for _, angle := range []float64{0, 3, -4.5, 7.2} {
+		rotated := toRGBA(imaging.Rotate(formula, angle, color.White), color.White)
+		if got := estimateSkew(rotated, bg); math.Abs(got-angle) > 0.3 {
+			t.Errorf("estimateSkew(rotated by %.1f°) = %.1f°", angle, got)
+		}
+	}
+}
+
+// 倾斜角度过小时不旋转，SkewAngle 也应为 0
+func TestProcessDeskewReportsNoRotation(t *testing.T) {
+	img := processFixture(t, unscaledPreprocessor(t, PreprocessOptions{Deskew: true}), "transparent_glyph.png")
+	if img.SkewAngle != 0 {
+		t.Errorf("SkewAngle = %.1f°, want 0 for an unrotated image", img.SkewAngle)
+	}
+	checkPixel(t, img, 30, 15, black)
+}
+
+// norm 返回 0-255 的通道值归一化后的结果
+func norm(v uint8) float32 {
+	return float32(v)/127.5 - 1
+}
+
+func TestLetterbox(t *testing.T) {
+	bg := color.RGBA{200, 100, 50, 255}
+	ink := color.RGBA{0, 0, 0, 255}
+	tests := []struct {
+		name    string
+		src     image.Rectangle
+		w, h    int
+		content image.Rectangle // 缩放后的图像在画布中的位置，其余为填充
+	}{
+		{"wide image is padded above and below", image.Rect(0, 0, 100, 50), 64, 64, image.Rect(0, 16, 64, 48)},
+		{"tall image is padded left and right", image.Rect(0, 0, 20, 80), 64, 64, image.Rect(24, 0, 40, 64)},
+		{"same aspect ratio is not padded", image.Rect(0, 0, 32, 16), 64, 32, image.Rect(0, 0, 64, 32)},
+		{"non-zero origin", image.Rect(10, 10, 110, 60), 64, 64, image.Rect(0, 16, 64, 48)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 背景色的图像，中间几行为墨迹，边缘像素全部为背景色
+			src := image.NewRGBA(tt.src)
+			for y := tt.src.Min.Y; y < tt.src.Max.Y; y++ {
+				for x := tt.src.Min.X; x < tt.src.Max.X; x++ {
+					src.SetRGBA(x, y, bg)
+				}
+			}
+			midY := (tt.src.Min.Y + tt.src.Max.Y) / 2
+			for y := midY - 2; y < midY+2; y++ {
+				for x := tt.src.Min.X + 1; x < tt.src.Max.X-1; x++ {
+					src.SetRGBA(x, y, ink)
+				}
+			}
+
+			out := letterbox(src, tt.w, tt.h, 0)
+			if got := out.Bounds(); got != image.Rect(0, 0, tt.w, tt.h) {
+				t.Fatalf("bounds = %v, want %v", got, image.Rect(0, 0, tt.w, tt.h))
+			}
+			inkPixels := 0
+			for y := 0; y < tt.h; y++ {
+				for x := 0; x < tt.w; x++ {
+					c := color.RGBAModel.Convert(out.At(x, y)).(color.RGBA)
+					inside := image.Pt(x, y).In(tt.content)
+					if !inside && c != bg {
+						t.Fatalf("padding pixel (%d,%d) = %v, want the border color %v", x, y, c, bg)
+					}
+					if c == ink {
+						if !inside {
+							t.Fatalf("ink at (%d,%d) outside %v", x, y, tt.content)
+						}
+						if x == tt.content.Min.X+tt.content.Dx()/2 {
+							inkPixels++
+						}
+					}
+				}
+			}
+			if inkPixels == 0 {
+				t.Errorf("ink missing from %v", tt.content)
+			}
+		})
+	}
+}
+
+func TestProcessLetterbox(t *testing.T) {
+	config := DefaultPreprocessorConfig()
+	config.Size = ImageSize{Height: fixtureWidth, Width: fixtureWidth}
+	p, err := NewPreprocessor(config, PreprocessOptions{ResizeMode: ResizeLetterbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join("testdata", "transparent_glyph.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := p.Run(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Shape[2] != fixtureWidth || img.Shape[3] != fixtureWidth {
+		t.Fatalf("shape = %v, want a %d×%d image", img.Shape, fixtureWidth, fixtureWidth)
+	}
+	// 64×32 的图像居中放在 64×64 的画布上，上下各填充 16 行白色
+	checkPixel(t, img, 30, 0, white)
+	checkPixel(t, img, 30, 10, white)
+	checkPixel(t, img, 30, 16+15, black)
+	checkPixel(t, img, 30, 53, white)
+	checkPixel(t, img, 30, 63, white)
+}
+
+func TestProcessAutoInvert(t *testing.T) {
+	tests := []struct {
+		name         string
+		fixture      string
+		autoInvert   bool
+		wantInverted bool
+		background   [3]float32 // (2,2) 处的背景
+		ink          [3]float32 // (30,15) 处的墨迹
+	}{
+		{"light on dark is inverted", "light_on_dark.png", true, true,
+			[3]float32{norm(235), norm(235), norm(215)}, [3]float32{norm(15), norm(15), norm(15)}},
+		{"light on dark is kept when disabled", "light_on_dark.png", false, false,
+			[3]float32{norm(20), norm(20), norm(40)}, [3]float32{norm(240), norm(240), norm(240)}},
+		{"dark on light is not inverted", "transparent_glyph.png", true, false, white, black},
+		{"light colored background is not inverted", "colored_background.png", true, false,
+			[3]float32{norm(255), norm(240), norm(160)}, [3]float32{norm(40), norm(60), norm(200)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := unscaledPreprocessor(t, PreprocessOptions{AutoInvert: tt.autoInvert})
+			img := processFixture(t, p, tt.fixture)
+			if img.Inverted != tt.wantInverted {
+				t.Errorf("Inverted = %v, want %v", img.Inverted, tt.wantInverted)
+			}
+			checkPixel(t, img, 2, 2, tt.background)
+			checkPixel(t, img, 30, 15, tt.ink)
+		})
+	}
+}
+
+func TestBorderColor(t *testing.T) {
+	bg := color.RGBA{255, 240, 160, 255}
+	ink := color.RGBA{40, 60, 200, 255}
+	tests := []struct {
+		name string
+		ink  image.Rectangle // 墨迹区域，可以接触边缘
+	}{
+		{"ink inside", image.Rect(8, 8, 24, 24)},
+		{"ink touches one edge", image.Rect(0, 8, 10, 24)},
+		{"ink covers a corner", image.Rect(0, 0, 12, 12)},
+		{"ink spans the top edge", image.Rect(0, 0, 32, 4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+			for y := 0; y < 32; y++ {
+				for x := 0; x < 32; x++ {
+					if image.Pt(x, y).In(tt.ink) {
+						img.SetRGBA(x, y, ink)
+					} else {
+						img.SetRGBA(x, y, bg)
+					}
+				}
+			}
+			if got := borderColor(img); got != bg {
+				t.Errorf("borderColor = %v, want %v", got, bg)
+			}
+		})
+	}
+}
+
+func TestTrimToInk(t *testing.T) {
+	bg := color.RGBA{255, 255, 255, 255}
+	ink := color.RGBA{0, 0, 0, 255}
+	square := image.Rect(0, 0, 32, 32)
+	offset := image.Rect(100, 50, 140, 80) // 原点不为 (0,0) 的图像，例如 SubImage 的结果
+	tests := []struct {
+		name     string
+		bounds   image.Rectangle
+		ink      image.Rectangle // 空矩形表示没有墨迹
+		margin   int
+		wantKept image.Rectangle
+	}{
+		{"ink inside", square, image.Rect(10, 12, 20, 16), 2, image.Rect(8, 10, 22, 18)},
+		{"no margin", square, image.Rect(5, 5, 6, 6), 0, image.Rect(5, 5, 6, 6)},
+		// 边距超出原图的部分不属于保留区域，但输出仍用背景色补齐
+		{"margin clipped at the top left", square, image.Rect(0, 0, 6, 4), 3, image.Rect(0, 0, 9, 7)},
+		{"margin clipped at the bottom right", square, image.Rect(28, 30, 32, 32), 2, image.Rect(26, 28, 32, 32)},
+		{"non-zero origin", offset, image.Rect(110, 60, 120, 65), 2, image.Rect(108, 58, 122, 67)},
+		{"non-zero origin clipped", offset, image.Rect(100, 75, 104, 80), 2, image.Rect(100, 73, 106, 80)},
+		{"no ink", offset, image.Rectangle{}, 2, offset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewRGBA(tt.bounds)
+			for y := tt.bounds.Min.Y; y < tt.bounds.Max.Y; y++ {
+				for x := tt.bounds.Min.X; x < tt.bounds.Max.X; x++ {
+					if image.Pt(x, y).In(tt.ink) {
+						img.SetRGBA(x, y, ink)
+					} else {
+						img.SetRGBA(x, y, bg)
+					}
+				}
+			}
+
+			out, kept := trimToInk(img, tt.margin)
+			if kept != tt.wantKept {
+				t.Errorf("kept = %v, want %v", kept, tt.wantKept)
+			}
+			if tt.ink.Empty() {
+				if out != img {
+					t.Error("trimToInk without ink should return the input image")
+				}
+				return
+			}
+
+			// 输出从 (0,0) 开始，大小为墨迹加上完整的边距，墨迹位于 (margin, margin)
+			crop := tt.ink.Inset(-tt.margin)
+			if want := image.Rect(0, 0, crop.Dx(), crop.Dy()); out.Bounds() != want {
+				t.Fatalf("out.Bounds() = %v, want %v", out.Bounds(), want)
+			}
+			inkOut := tt.ink.Sub(crop.Min)
+			for y := 0; y < crop.Dy(); y++ {
+				for x := 0; x < crop.Dx(); x++ {
+					want := bg
+					if image.Pt(x, y).In(inkOut) {
+						want = ink
+					}
+					if got := out.RGBAAt(x, y); got != want {
+						t.Fatalf("out(%d,%d) = %v, want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProcessGrayscale(t *testing.T) {
+	img := processFixture(t, unscaledPreprocessor(t, PreprocessOptions{Grayscale: true}), "colored_background.png")
+	// 亮度按 0.299R + 0.587G + 0.114B 计算
+	checkPixel(t, img, 2, 2, [3]float32{norm(235), norm(235), norm(235)})
+	checkPixel(t, img, 30, 15, [3]float32{norm(70), norm(70), norm(70)})
+}
+
+func TestProcessNormalizeBackground(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		options PreprocessOptions
+		ink     [3]float32
+	}{
+		// 与背景的最大通道差为 215，映射为 255-215=40
+		{"colored background", "colored_background.png", PreprocessOptions{NormalizeBackground: true},
+			[3]float32{norm(40), norm(40), norm(40)}},
+		// 反色后背景为 (235,235,215)，墨迹为 15，最大通道差为 220，映射为 255-220*255/235
+		{"after inversion", "light_on_dark.png", PreprocessOptions{AutoInvert: true, NormalizeBackground: true},
+			[3]float32{norm(17), norm(17), norm(17)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := processFixture(t, unscaledPreprocessor(t, tt.options), tt.fixture)
+			checkPixel(t, img, 2, 2, white)
+			checkPixel(t, img, 30, 15, tt.ink)
+		})
+	}
+}
+
+func TestLoadPreprocessorConfig(t *testing.T) {
+	half := [3]float32{0.5, 0.5, 0.5}
+	tests := []struct {
+		name      string
+		json      string // 为空表示没有 preprocessor_config.json
+		wantErr   bool   // LoadPreprocessorConfig 或 NewPreprocessor 应当失败
+		mean, std [3]float32
+		wide      image.Point // 800×200 的图像缩放后的尺寸
+		tall      image.Point // 200×800 的图像缩放后的尺寸
+	}{
+		{name: "no file", mean: half, std: half, wide: image.Pt(384, 384), tall: image.Pt(384, 384)},
+		{name: "other fields keep the default size", json: `{"resample": 2}`,
+			mean: half, std: half, wide: image.Pt(384, 384), tall: image.Pt(384, 384)},
+		{name: "height and width", json: `{"size": {"height": 64, "width": 128}}`,
+			mean: half, std: half, wide: image.Pt(128, 64), tall: image.Pt(128, 64)},
+		{name: "shortest edge only", json: `{"size": {"shortest_edge": 224}}`,
+			mean: half, std: half, wide: image.Pt(896, 224), tall: image.Pt(224, 896)},
+		{name: "scalar mean and std", json: `{"image_mean": 0.4, "image_std": 0.2}`,
+			mean: [3]float32{0.4, 0.4, 0.4}, std: [3]float32{0.2, 0.2, 0.2}, wide: image.Pt(384, 384), tall: image.Pt(384, 384)},
+		{name: "single value arrays", json: `{"image_mean": [0.4], "image_std": [0.2]}`,
+			mean: [3]float32{0.4, 0.4, 0.4}, std: [3]float32{0.2, 0.2, 0.2}, wide: image.Pt(384, 384), tall: image.Pt(384, 384)},
+		{name: "per-channel mean and std", json: `{"image_mean": [0.485, 0.456, 0.406], "image_std": [0.229, 0.224, 0.225]}`,
+			mean: [3]float32{0.485, 0.456, 0.406}, std: [3]float32{0.229, 0.224, 0.225}, wide: image.Pt(384, 384), tall: image.Pt(384, 384)},
+		{name: "normalization disabled", json: `{"do_normalize": false, "image_std": 0}`,
+			mean: [3]float32{0, 0, 0}, std: [3]float32{1, 1, 1}, wide: image.Pt(384, 384), tall: image.Pt(384, 384)},
+		{name: "zero std", json: `{"image_std": 0}`, wantErr: true},
+		{name: "zero std in one channel", json: `{"image_std": [0.5, 0, 0.5]}`, wantErr: true},
+		{name: "two mean values", json: `{"image_mean": [0.5, 0.5]}`, wantErr: true},
+		{name: "invalid size", json: `{"size": {"height": 64}}`, wantErr: true},
+		{name: "invalid crop size", json: `{"do_center_crop": true, "crop_size": {"height": 32}}`, wantErr: true},
+		{name: "unsupported resample filter", json: `{"resample": 7}`, wantErr: true},
+		{name: "malformed json", json: `{"size": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			if tt.json != "" {
+				fsys[PreprocessorConfigFile] = &fstest.MapFile{Data: []byte(tt.json)}
+			}
+			config, err := LoadPreprocessorConfig(fsys)
+			var p *Preprocessor
+			if err == nil {
+				p, err = NewPreprocessor(config, PreprocessOptions{})
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for c := 0; c < 3; c++ {
+				if math.Abs(float64(p.mean[c]-tt.mean[c])) > 1e-6 || math.Abs(float64(p.std[c]-tt.std[c])) > 1e-6 {
+					t.Fatalf("mean, std = %v, %v, want %v, %v", p.mean, p.std, tt.mean, tt.std)
+				}
+			}
+			if w, h := p.targetSize(image.Rect(0, 0, 800, 200)); image.Pt(w, h) != tt.wide {
+				t.Errorf("targetSize(800×200) = %d×%d, want %d×%d", w, h, tt.wide.X, tt.wide.Y)
+			}
+			if w, h := p.targetSize(image.Rect(0, 0, 200, 800)); image.Pt(w, h) != tt.tall {
+				t.Errorf("targetSize(200×800) = %d×%d, want %d×%d", w, h, tt.tall.X, tt.tall.Y)
+			}
+		})
+	}
+}
+
+func TestProcessCenterCrop(t *testing.T) {
+	config := DefaultPreprocessorConfig()
+	config.Size = ImageSize{Height: fixtureHeight, Width: fixtureWidth}
+	config.DoCenterCrop = true
+	config.CropSize = ImageSize{Height: 16, Width: 16}
+	p, err := NewPreprocessor(config, PreprocessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join("testdata", "transparent_glyph.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := p.Run(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Shape[2] != 16 || img.Shape[3] != 16 {
+		t.Fatalf("shape = %v, want a 16×16 image", img.Shape)
+	}
+	// 中心 16×16 的区域正好是黑色方块
+	checkPixel(t, img, 0, 0, black)
+	checkPixel(t, img, 15, 15, black)
+}
+
+// 大面积“墨迹”（如光照不均的白板照片）时，取样点数不能随像素数增长
+func BenchmarkEstimateSkewNoisy(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 2000, 1500))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7 % 256)
+	}
+	bg := color.RGBA{255, 255, 255, 255}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		estimateSkew(img, bg)
+	}
+}
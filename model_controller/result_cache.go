@@ -0,0 +1,308 @@
+package model_controller
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDiskCacheEntries bounds the on-disk result cache when
+// CacheConfig.DiskEntries is not set.
+const DefaultDiskCacheEntries = 4096
+
+// CacheConfig configures the result cache, which lets repeated recognitions
+// of the same image skip the encoder and decoder.
+type CacheConfig struct {
+	// Entries is the number of results kept in memory. Zero disables the
+	// cache entirely.
+	Entries int
+	// Dir, if set, also stores results on disk so they survive restarts.
+	Dir string
+	// DiskEntries is the number of results kept in Dir. Values below 1
+	// mean DefaultDiskCacheEntries.
+	DiskEntries int
+}
+
+// CacheStats reports the size and effectiveness of the result cache.
+type CacheStats struct {
+	Entries     int    // results held in memory
+	DiskEntries int    // results held on disk
+	Hits        uint64 // lookups answered from memory or disk
+	Misses      uint64 // lookups that had to run the models
+}
+
+// cachedGeneration is the decoder output stored for one image. The format
+// conversion is cheap and depends on the requested output format, so it is
+// not cached.
+type cachedGeneration struct {
+	Tokens   []uint32  `json:"tokens"`
+	LogProbs []float32 `json:"log_probs"`
+	Score    float64   `json:"score"`
+	Looped   bool      `json:"looped"`
+}
+
+type cacheEntry struct {
+	key string
+	gen cachedGeneration
+}
+
+// resultCache is an LRU cache of generations keyed by a hash of the
+// preprocessed image, the model and the decoding settings, optionally backed
+// by one JSON file per entry in a directory.
+type resultCache struct {
+	mu          sync.Mutex
+	entries     int
+	items       map[string]*list.Element
+	order       *list.List // front is most recently used
+	dir         string
+	diskEntries int
+	diskCount   int
+	hits        uint64
+	misses      uint64
+}
+
+func newResultCache(cfg CacheConfig) *resultCache {
+	c := &resultCache{
+		entries:     cfg.Entries,
+		items:       make(map[string]*list.Element),
+		order:       list.New(),
+		dir:         cfg.Dir,
+		diskEntries: cfg.DiskEntries,
+	}
+	if c.diskEntries < 1 {
+		c.diskEntries = DefaultDiskCacheEntries
+	}
+	if c.dir != "" {
+		if err := os.MkdirAll(c.dir, 0750); err != nil {
+			log.Printf("Warning: Could not create cache directory %s: %v. Caching in memory only.", c.dir, err)
+			c.dir = ""
+		} else {
+			c.diskCount = len(c.diskFiles())
+		}
+	}
+	return c
+}
+
+// imageHash hashes a preprocessed image tensor.
+func imageHash(shape []int64, tensor []float32) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\x00", shape)
+	buf := make([]byte, 4)
+	for _, v := range tensor {
+		binary.LittleEndian.PutUint32(buf, math.Float32bits(v))
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheKey combines the model identity, the decoding settings and the image
+// hash into the key of a cached result.
+func cacheKey(modelID, decoding, image string) string {
+	sum := sha256.Sum256([]byte(modelID + "\x00" + decoding + "\x00" + image))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the generation cached under key, looking on disk after memory.
+func (c *resultCache) get(key string) (*Generation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.order.MoveToFront(elem)
+		c.hits++
+		return elem.Value.(*cacheEntry).gen.generation(), true
+	}
+	if c.dir != "" {
+		if gen, ok := c.readDisk(key); ok {
+			c.insert(key, gen)
+			c.hits++
+			return gen.generation(), true
+		}
+	}
+	c.misses++
+	return nil, false
+}
+
+// put stores gen under key in memory and, if configured, on disk.
+func (c *resultCache) put(key string, gen *Generation) {
+	cached := cachedGeneration{
+		Tokens:   append([]uint32(nil), gen.Tokens...),
+		LogProbs: append([]float32(nil), gen.LogProbs...),
+		Score:    gen.Score,
+		Looped:   gen.Looped,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insert(key, cached)
+	if c.dir != "" {
+		c.writeDisk(key, cached)
+	}
+}
+
+// clear removes every cached result from memory and disk.
+func (c *resultCache) clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	if c.dir == "" {
+		return nil
+	}
+	var errs []error
+	for _, name := range c.diskFiles() {
+		if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	c.diskCount = len(c.diskFiles())
+	return errors.Join(errs...)
+}
+
+func (c *resultCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:     c.order.Len(),
+		DiskEntries: c.diskCount,
+		Hits:        c.hits,
+		Misses:      c.misses,
+	}
+}
+
+// insert adds an entry to the in-memory LRU; c.mu must be held.
+func (c *resultCache) insert(key string, gen cachedGeneration) {
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*cacheEntry).gen = gen
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, gen: gen})
+	for c.order.Len() > c.entries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *resultCache) diskPath(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// diskFiles lists the cache files in c.dir.
+func (c *resultCache) diskFiles() []string {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range dirEntries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// readDisk loads an entry from disk and marks it as recently used; c.mu
+// must be held.
+func (c *resultCache) readDisk(key string) (cachedGeneration, bool) {
+	var gen cachedGeneration
+	path := c.diskPath(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return gen, false
+	}
+	if err := json.Unmarshal(data, &gen); err != nil || len(gen.Tokens) != len(gen.LogProbs) {
+		log.Printf("Warning: Removing corrupt cache entry %s", path)
+		os.Remove(path)
+		c.diskCount--
+		return gen, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return gen, true
+}
+
+// writeDisk stores an entry on disk, evicting the least recently used files
+// beyond c.diskEntries; c.mu must be held.
+func (c *resultCache) writeDisk(key string, gen cachedGeneration) {
+	data, err := json.Marshal(gen)
+	if err != nil {
+		log.Printf("Warning: Could not encode cache entry: %v", err)
+		return
+	}
+	path := c.diskPath(key)
+	_, statErr := os.Stat(path)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		log.Printf("Warning: Could not write cache entry: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		log.Printf("Warning: Could not write cache entry: %v", err)
+		return
+	}
+	if statErr != nil {
+		c.diskCount++
+	}
+	if c.diskCount > c.diskEntries {
+		c.evictDisk()
+	}
+}
+
+// evictDisk removes the least recently used files until at most
+// c.diskEntries remain; c.mu must be held.
+func (c *resultCache) evictDisk() {
+	type file struct {
+		name    string
+		modTime time.Time
+	}
+	var files []file
+	for _, name := range c.diskFiles() {
+		info, err := os.Stat(filepath.Join(c.dir, name))
+		if err != nil {
+			continue
+		}
+		files = append(files, file{name, info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for len(files) > c.diskEntries {
+		os.Remove(filepath.Join(c.dir, files[0].name))
+		files = files[1:]
+	}
+	c.diskCount = len(files)
+}
+
+func (g cachedGeneration) generation() *Generation {
+	return &Generation{
+		Tokens:   append([]uint32(nil), g.Tokens...),
+		LogProbs: append([]float32(nil), g.LogProbs...),
+		Score:    g.Score,
+		Looped:   g.Looped,
+	}
+}
+
+// modelIdentity hashes the model files so that cached results of one model
+// are never returned for another.
+func modelIdentity(files ...[]byte) string {
+	h := sha256.New()
+	for _, data := range files {
+		fmt.Fprintf(h, "%d\x00", len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
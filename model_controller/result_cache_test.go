@@ -0,0 +1,144 @@
+package model_controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testGeneration(token uint32) *Generation {
+	return &Generation{Tokens: []uint32{2, token, 2}, LogProbs: []float32{0, -0.5, -0.1}, Score: -0.6}
+}
+
+// checkCached 检查 key 是否命中缓存，命中时检查内容与 testGeneration(token) 一致
+func checkCached(t *testing.T, c *resultCache, key string, token uint32, want bool) {
+	t.Helper()
+	gen, ok := c.get(key)
+	if ok != want {
+		t.Fatalf("get(%q) hit = %v, want %v", key, ok, want)
+	}
+	if ok && (len(gen.Tokens) != 3 || gen.Tokens[1] != token || gen.Score != -0.6) {
+		t.Errorf("get(%q) = %+v, want token %d", key, gen, token)
+	}
+}
+
+// setAge 将缓存文件的修改时间设为 age 之前，使磁盘淘汰顺序确定
+func setAge(t *testing.T, c *resultCache, key string, age time.Duration) {
+	t.Helper()
+	when := time.Now().Add(-age)
+	if err := os.Chtimes(c.diskPath(key), when, when); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResultCacheMemoryEviction(t *testing.T) {
+	c := newResultCache(CacheConfig{Entries: 2})
+	c.put("a", testGeneration(10))
+	c.put("b", testGeneration(11))
+	checkCached(t, c, "a", 10, true) // a 变为最近使用
+	c.put("c", testGeneration(12))
+
+	checkCached(t, c, "b", 0, false)
+	checkCached(t, c, "a", 10, true)
+	checkCached(t, c, "c", 12, true)
+	stats := c.stats()
+	if stats.Entries != 2 || stats.DiskEntries != 0 {
+		t.Errorf("stats = %+v, want 2 entries in memory and none on disk", stats)
+	}
+	if stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("stats = %+v, want 3 hits and 1 miss", stats)
+	}
+}
+
+func TestResultCacheDiskEviction(t *testing.T) {
+	dir := t.TempDir()
+	c := newResultCache(CacheConfig{Entries: 1, Dir: dir, DiskEntries: 2})
+	c.put("a", testGeneration(10))
+	setAge(t, c, "a", 2*time.Hour)
+	c.put("b", testGeneration(11))
+	setAge(t, c, "b", time.Hour)
+	c.put("c", testGeneration(12))
+
+	if _, err := os.Stat(c.diskPath("a")); !os.IsNotExist(err) {
+		t.Errorf("least recently used entry still on disk: %v", err)
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, err := os.Stat(c.diskPath(key)); err != nil {
+			t.Errorf("entry %s missing from disk: %v", key, err)
+		}
+	}
+	if stats := c.stats(); stats.Entries != 1 || stats.DiskEntries != 2 {
+		t.Errorf("stats = %+v, want 1 entry in memory and 2 on disk", stats)
+	}
+	// b 只在磁盘上，读取后回到内存
+	checkCached(t, c, "b", 11, true)
+	checkCached(t, c, "a", 0, false)
+}
+
+func TestResultCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	c := newResultCache(CacheConfig{Entries: 4, Dir: dir})
+	c.put("a", testGeneration(10))
+	c.put("b", testGeneration(11))
+
+	reopened := newResultCache(CacheConfig{Entries: 4, Dir: dir})
+	if stats := reopened.stats(); stats.Entries != 0 || stats.DiskEntries != 2 {
+		t.Fatalf("stats after reopening = %+v, want 0 entries in memory and 2 on disk", stats)
+	}
+	checkCached(t, reopened, "a", 10, true)
+	checkCached(t, reopened, "b", 11, true)
+	checkCached(t, reopened, "c", 0, false)
+	if stats := reopened.stats(); stats.Entries != 2 || stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("stats = %+v, want 2 entries in memory, 2 hits and 1 miss", stats)
+	}
+}
+
+func TestResultCacheRemovesCorruptEntries(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"invalid json", "{not json"},
+		{"mismatched log probs", `{"tokens":[2,10,2],"log_probs":[0],"score":-1,"looped":false}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "a.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0640); err != nil {
+				t.Fatal(err)
+			}
+			c := newResultCache(CacheConfig{Entries: 4, Dir: dir})
+			checkCached(t, c, "a", 0, false)
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("corrupt entry still on disk: %v", err)
+			}
+			if stats := c.stats(); stats.DiskEntries != 0 {
+				t.Errorf("stats = %+v, want no entries on disk", stats)
+			}
+		})
+	}
+}
+
+func TestResultCacheClear(t *testing.T) {
+	dir := t.TempDir()
+	c := newResultCache(CacheConfig{Entries: 4, Dir: dir})
+	c.put("a", testGeneration(10))
+	c.put("b", testGeneration(11))
+
+	if err := c.clear(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.stats(); stats.Entries != 0 || stats.DiskEntries != 0 {
+		t.Errorf("stats after clear = %+v, want an empty cache", stats)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d files left in the cache directory", len(files))
+	}
+	checkCached(t, c, "a", 0, false)
+}
@@ -1,143 +1,436 @@
 package model_controller
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"image"
+	"image/draw"
+	"image/png"
 	"log"
-	"os"
 	"strings"
 
 	"github.com/dop251/goja"
 	onnxruntime "github.com/yalue/onnxruntime_go"
 )
 
-var tk *Tokenizer
-var katexJSCode []byte
-var mathml2ommlJSCode []byte // For mathml2omml.js
-var encoderModel *Encoder
-var decoderModel *Decoder
-
-func InitKaTeX(data []byte) {
-	katexJSCode = data
-	if len(katexJSCode) == 0 {
-		log.Println("Warning: KaTeX JS data is empty during InitKaTeX.")
+// SetBeamSearch configures beam search decoding for subsequent predictions.
+// A numBeams value of 1 or less keeps the default greedy decoding. It
+// returns ErrModelsNotLoaded once the engine has been closed.
+func (e *Engine) SetBeamSearch(numBeams int, lengthPenalty float64, earlyStopping bool) error {
+	pairs, err := e.pool.acquireAll()
+	if err != nil {
+		return err
+	}
+	defer e.pool.releaseAll(pairs)
+	for _, pair := range pairs {
+		pair.decoder.SetBeamSearch(numBeams, lengthPenalty, earlyStopping)
 	}
+	e.decodingMu.Lock()
+	e.numBeams, e.lengthPenalty, e.earlyStopping = numBeams, lengthPenalty, earlyStopping
+	e.decodingMu.Unlock()
+	log.Printf("Decoding configured: num_beams=%d, length_penalty=%.2f, early_stopping=%v", numBeams, lengthPenalty, earlyStopping)
+	return nil
 }
 
-// InitMathML2OMMLJS stores the mathml2omml.js code.
-func InitMathML2OMMLJS(data []byte) {
-	mathml2ommlJSCode = data
-	if len(mathml2ommlJSCode) == 0 {
-		log.Println("Warning: mathml2omml.js data is empty during Init.")
+// SetLoopDetection sets how many times a short run of tokens must repeat at
+// the end of the output before decoding stops and the result is flagged as
+// looped. Zero disables loop detection. It overrides the model's
+// loop_repeats and returns ErrModelsNotLoaded once the engine has been
+// closed.
+func (e *Engine) SetLoopDetection(repeats int) error {
+	if repeats < 0 {
+		repeats = 0
+	}
+	pairs, err := e.pool.acquireAll()
+	if err != nil {
+		return err
+	}
+	defer e.pool.releaseAll(pairs)
+	for _, pair := range pairs {
+		pair.decoder.SetLoopRepeats(repeats)
 	}
+	e.decodingMu.Lock()
+	e.loopRepeats = repeats
+	e.decodingMu.Unlock()
+	log.Printf("Loop detection: %d repeats (0 = disabled)", repeats)
+	return nil
 }
 
-func InitTokenizer(path string) error {
-	t, err := NewTokenizer(path)
+// SetGrammarConstraint enables or disables grammar-constrained decoding for
+// subsequent predictions. When enabled, tokens that would leave braces,
+// \left or \begin{...} unbalanced, or a command such as \frac without its
+// arguments, are masked out during decoding. It returns ErrModelsNotLoaded
+// once the engine has been closed.
+func (e *Engine) SetGrammarConstraint(enabled bool) error {
+	pairs, err := e.pool.acquireAll()
 	if err != nil {
-		return fmt.Errorf("failed to initialize tokenizer: %w", err)
+		return err
+	}
+	defer e.pool.releaseAll(pairs)
+	for _, pair := range pairs {
+		if enabled {
+			pair.decoder.SetGrammar(e.grammar)
+		} else {
+			pair.decoder.SetGrammar(nil)
+		}
 	}
-	tk = t
+	e.decodingMu.Lock()
+	e.grammarConstrained = enabled
+	e.decodingMu.Unlock()
+	log.Printf("Grammar-constrained decoding: %v", enabled)
 	return nil
 }
 
-func InitModels(encoderPath, decoderPath string) error {
-	var err error
-	encoderModel, err = NewEncoder(encoderPath, false, false)
+// PredictionResult is the outcome of recognizing a single image.
+type PredictionResult struct {
+	Text     string    // Result in the requested output format
+	LaTeX    string    // Decoded LaTeX before format conversion
+	Tokens   []uint32  // Generated token IDs, including the start and EOS tokens
+	LogProbs []float32 // Raw log-probability of each token, aligned with Tokens (0 for the start token)
+	Score    float64   // Decoder score used to rank hypotheses (length-normalized for beam search)
+
+	// Confidence is the geometric mean of the generated token probabilities, in
+	// [0, 1]. Like LogProbs it reflects the model's raw distribution, before the
+	// repetition penalty and the LaTeX grammar mask reshape it.
+	Confidence float64
+	// LowestConfidenceSpan is the least certain part of the recognition, useful for manual review.
+	LowestConfidenceSpan ConfidenceSpan
+	// Looped reports that decoding was stopped because the output kept
+	// repeating the same tokens; the result is likely truncated or wrong.
+	Looped bool
+
+	// CropRect is the region that was recognized. It is the whole image
+	// unless whitespace trimming is enabled. It is in the input image's
+	// coordinates unless SkewAngle is non-zero: trimming then runs on the
+	// deskewed image, the input rotated by -SkewAngle about its center onto
+	// a canvas enlarged to fit, and the rectangle is in that image's
+	// coordinates.
+	CropRect image.Rectangle
+	// SkewAngle is the rotation, in degrees counterclockwise, that was undone
+	// before recognition. It is 0 when deskewing is disabled or the detected
+	// angle was too small to be worth rotating.
+	SkewAngle float64
+}
+
+// Predict recognizes the formula in imageData and returns it in outputFormat
+// ("latex", "mathml" or "omml") together with its confidence scores.
+func (e *Engine) Predict(imageData []byte, outputFormat string) (*PredictionResult, error) {
+	return e.PredictContext(context.Background(), imageData, outputFormat)
+}
+
+// PredictContext is like Predict but stops early when ctx is cancelled or
+// times out. Cancellation is checked between decoder steps and interrupts
+// the format conversion scripts; the returned error then wraps ctx.Err().
+func (e *Engine) PredictContext(ctx context.Context, imageData []byte, outputFormat string) (*PredictionResult, error) {
+	return e.PredictStream(ctx, imageData, outputFormat, nil)
+}
+
+// PartialFunc receives the LaTeX decoded so far while a prediction runs.
+type PartialFunc func(latex string)
+
+// PredictStream is like PredictContext but calls onPartial, if not nil,
+// with the decoded LaTeX prefix after every generated token. With beam
+// search the prefix is that of the currently best beam. onPartial runs on
+// the decoding goroutine and should return quickly.
+func (e *Engine) PredictStream(ctx context.Context, imageData []byte, outputFormat string, onPartial PartialFunc) (*PredictionResult, error) {
+	// Close waits for this before destroying the sessions and tokenizer
+	e.closeMu.RLock()
+	defer e.closeMu.RUnlock()
+	if err := e.checkLoaded(); err != nil {
+		return nil, err
+	}
+	var onStep StepFunc
+	if onPartial != nil {
+		onStep = func(tokens []uint32) {
+			onPartial(e.tokenizer.Decode(tokens))
+		}
+	}
+	img, err := e.preprocessImage(imageData)
+	if err != nil {
+		return nil, err
+	}
+	gen, err := e.generate(ctx, img, onStep)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Generated tokens:", gen.Tokens)
+
+	result := e.newPredictionResult(gen, img)
+	log.Printf("Recognition confidence: %.3f (lowest span %q at %.3f)", result.Confidence, result.LowestConfidenceSpan.Text, result.LowestConfidenceSpan.Confidence)
+
+	result.Text, err = e.formatLatex(ctx, result.LaTeX, outputFormat)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// PredictNBest returns up to n distinct LaTeX hypotheses for the image,
+// best first, each converted to outputFormat and scored.
+func (e *Engine) PredictNBest(imageData []byte, outputFormat string, n int) ([]*PredictionResult, error) {
+	return e.PredictNBestContext(context.Background(), imageData, outputFormat, n)
+}
+
+// PredictNBestContext is like PredictNBest but stops early when ctx is
+// cancelled or times out.
+func (e *Engine) PredictNBestContext(ctx context.Context, imageData []byte, outputFormat string, n int) ([]*PredictionResult, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of hypotheses: %d", n)
+	}
+	// Close waits for this before destroying the sessions and tokenizer
+	e.closeMu.RLock()
+	defer e.closeMu.RUnlock()
+	if err := e.checkLoaded(); err != nil {
+		return nil, err
+	}
+
+	img, err := e.preprocessImage(imageData)
 	if err != nil {
-		return fmt.Errorf("failed to initialize encoder: %w", err)
+		return nil, err
 	}
-	decoderModel, err = NewDecoder(decoderPath, false, false)
+	gens, err := e.generateNBest(ctx, img, n)
 	if err != nil {
-		return fmt.Errorf("failed to initialize decoder: %w", err)
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var results []*PredictionResult
+	for _, gen := range gens {
+		result := e.newPredictionResult(gen, img)
+		if seen[result.LaTeX] {
+			continue
+		}
+		seen[result.LaTeX] = true
+
+		result.Text, err = e.formatLatex(ctx, result.LaTeX, outputFormat)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+		if len(results) == n {
+			break
+		}
+	}
+	log.Printf("Generated %d alternative hypotheses", len(results))
+	return results, nil
+}
+
+// checkLoaded reports whether the engine can still recognize images, i.e.
+// it has not been closed.
+func (e *Engine) checkLoaded() error {
+	if e.pool.isClosed() {
+		return ErrModelsNotLoaded
+	}
+	if e.tokenizer == nil {
+		return ErrTokenizerNotLoaded
 	}
-	log.Println("Encoder and Decoder initialized successfully.")
 	return nil
 }
 
-func ProcessImagePrediction(imageData []byte, outputFormat string) (resultText string, resultTokens []uint32, err error) {
-	if encoderModel == nil || decoderModel == nil {
-		return "", nil, fmt.Errorf("models not initialized. Call InitModels first")
+// generate runs the encoder and decoder on the image using a session pair
+// from the pool. When the result cache holds the image, the models are
+// skipped and onStep is called once with the cached tokens.
+func (e *Engine) generate(ctx context.Context, img *PreprocessedImage, onStep StepFunc) (*Generation, error) {
+	var imageKey string
+	if e.cache != nil {
+		imageKey = imageHash(img.Shape, img.Data)
+		if gen, ok := e.cache.get(cacheKey(e.modelID, e.decodingKey(), imageKey)); ok {
+			log.Println("Result cache hit; skipping the encoder and decoder.")
+			if onStep != nil {
+				onStep(gen.Tokens)
+			}
+			return gen, nil
+		}
+	}
+
+	pair, err := e.pool.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer e.pool.release(pair)
+
+	outputValue, err := e.encodeImage(ctx, pair.encoder, img)
+	if err != nil {
+		return nil, err
 	}
-	if tk == nil {
-		return "", nil, fmt.Errorf("tokenizer not initialized. Call InitTokenizer first")
+	gen, err := pair.decoder.GenerateStream(ctx, outputValue, onStep)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecoder, err)
+	}
+	if e.cache != nil {
+		// The decoding settings cannot change while a session pair is held,
+		// so this key matches the settings the result was generated with.
+		e.cache.put(cacheKey(e.modelID, e.decodingKey(), imageKey), gen)
 	}
+	return gen, nil
+}
 
-	tmpFile, err := ioutil.TempFile("", "tempimage-*.png")
+// generateNBest is like generate but returns beam search hypotheses for up
+// to n distinct results. Its results are not cached.
+func (e *Engine) generateNBest(ctx context.Context, img *PreprocessedImage, n int) ([]*Generation, error) {
+	pair, err := e.pool.acquire(ctx)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to create temporary image file: %w", err)
+		return nil, err
 	}
-	defer os.Remove(tmpFile.Name())
+	defer e.pool.release(pair)
 
-	if _, err := tmpFile.Write(imageData); err != nil {
-		tmpFile.Close()
-		return "", nil, fmt.Errorf("failed to write image data to temporary file: %w", err)
+	outputValue, err := e.encodeImage(ctx, pair.encoder, img)
+	if err != nil {
+		return nil, err
 	}
-	if err := tmpFile.Close(); err != nil {
-		return "", nil, fmt.Errorf("failed to close temporary image file: %w", err)
+	// Request extra beams since different token sequences can decode to the same LaTeX.
+	gens, err := pair.decoder.GenerateNBest(ctx, outputValue, 2*n)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecoder, err)
 	}
+	return gens, nil
+}
 
-	fileForProcessing, err := os.Open(tmpFile.Name())
+// WarmUp recognizes a blank image once on every session pair, so that the
+// first real recognition does not pay for ONNX Runtime's lazy
+// initialization. The results are discarded and never cached.
+func (e *Engine) WarmUp(ctx context.Context) error {
+	// Close waits for this before destroying the sessions and tokenizer
+	e.closeMu.RLock()
+	defer e.closeMu.RUnlock()
+	if err := e.checkLoaded(); err != nil {
+		return err
+	}
+	blank := image.NewGray(image.Rect(0, 0, 64, 64))
+	draw.Draw(blank, blank.Bounds(), image.White, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, blank); err != nil {
+		return fmt.Errorf("failed to encode warm-up image: %w", err)
+	}
+	img, err := e.preprocessImage(buf.Bytes())
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to reopen temporary image file for processing: %w", err)
+		return err
 	}
-	defer fileForProcessing.Close()
 
-	encoderData, encoderShape, err := PreprocessToModelFormat(fileForProcessing)
+	pairs, err := e.pool.acquireAll()
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to preprocess image: %w", err)
+		return err
+	}
+	defer e.pool.releaseAll(pairs)
+	for _, pair := range pairs {
+		outputValue, err := e.encodeImage(ctx, pair.encoder, img)
+		if err != nil {
+			return err
+		}
+		if _, err := pair.decoder.Generate(ctx, outputValue); err != nil {
+			return fmt.Errorf("%w: %w", ErrDecoder, err)
+		}
 	}
+	return nil
+}
+
+// decodingKey describes the decoding settings that affect a generation.
+func (e *Engine) decodingKey() string {
+	e.decodingMu.Lock()
+	defer e.decodingMu.Unlock()
+	// logprobs=raw keeps results cached before LogProbs switched to the raw
+	// distribution from being served with the old confidence values.
+	return fmt.Sprintf("beams=%d lp=%g early=%v grammar=%v loop=%d logprobs=raw", e.numBeams, e.lengthPenalty, e.earlyStopping, e.grammarConstrained, e.loopRepeats)
+}
 
-	inputTensor, err := onnxruntime.NewTensor(encoderShape, encoderData)
+// preprocessImage decodes the image and converts it to the encoder's input tensor.
+func (e *Engine) preprocessImage(imageData []byte) (*PreprocessedImage, error) {
+	img, err := e.preprocessor.Run(bytes.NewReader(imageData))
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to create encoder input tensor: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrImageDecode, err)
 	}
+	if img.Inverted {
+		log.Println("Image has a dark background; inverted it before recognition.")
+	}
+	return img, nil
+}
 
-	outputValue, err := encoderModel.Run([]onnxruntime.Value{inputTensor})
+// encodeImage runs the encoder on a preprocessed image tensor.
+func (e *Engine) encodeImage(ctx context.Context, encoder *Encoder, img *PreprocessedImage) (*EncoderOutput, error) {
+	inputTensor, err := onnxruntime.NewTensor(img.Shape, img.Data)
 	if err != nil {
-		return "", nil, fmt.Errorf("encoder run failed: %w", err)
+		return nil, fmt.Errorf("%w: failed to create input tensor: %w", ErrEncoder, err)
 	}
+	defer inputTensor.Destroy()
 
-	tokens, err := decoderModel.Generate(outputValue)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	outputValue, err := encoder.Run([]onnxruntime.Value{inputTensor})
 	if err != nil {
-		return "", nil, fmt.Errorf("decoder generation failed: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrEncoder, err)
 	}
-	log.Println("Generated tokens:", tokens)
+	return outputValue, nil
+}
 
-	latex := tk.Decode(tokens)
+// newPredictionResult decodes a generation and computes its confidence scores.
+func (e *Engine) newPredictionResult(gen *Generation, img *PreprocessedImage) *PredictionResult {
+	result := &PredictionResult{
+		CropRect:   img.CropRect,
+		SkewAngle:  img.SkewAngle,
+		LaTeX:      e.tokenizer.Decode(gen.Tokens),
+		Tokens:     gen.Tokens,
+		LogProbs:   gen.LogProbs,
+		Score:      gen.Score,
+		Confidence: sequenceConfidence(gen.LogProbs),
+		Looped:     gen.Looped,
+	}
+	eos := uint32(e.eosTokenID)
+	if start, end, confidence, ok := lowestConfidenceSpan(gen.Tokens, gen.LogProbs, eos); ok {
+		result.LowestConfidenceSpan = ConfidenceSpan{
+			Start:      start,
+			End:        end,
+			Text:       e.tokenizer.Decode(gen.Tokens[start:end]),
+			Confidence: confidence,
+		}
+	}
+	return result
+}
 
+// formatLatex converts recognized LaTeX into the requested output format.
+func (e *Engine) formatLatex(ctx context.Context, latex string, outputFormat string) (string, error) {
 	switch outputFormat {
 	case "latex":
-		resultText = latex
+		return latex, nil
 	case "mathml":
-		mathml, errConv := convertLatexToMathML(latex)
+		mathml, errConv := e.convertLatexToMathML(ctx, latex)
 		if errConv != nil {
-			return "", tokens, fmt.Errorf("LaTeX to MathML conversion failed: %w", errConv)
+			return "", fmt.Errorf("%w: LaTeX to MathML: %w", ErrConversion, errConv)
 		}
-		resultText = mathml
+		return mathml, nil
 	case "omml": // OMML re-enabled
-		mathml, errConv := convertLatexToMathML(latex)
+		mathml, errConv := e.convertLatexToMathML(ctx, latex)
 		if errConv != nil {
-			return "", tokens, fmt.Errorf("LaTeX to MathML conversion failed: %w", errConv)
+			return "", fmt.Errorf("%w: LaTeX to MathML: %w", ErrConversion, errConv)
 		}
-		omml, errConv := convertMathMLToOMML(mathml)
+		omml, errConv := e.convertMathMLToOMML(ctx, mathml)
 		if errConv != nil {
-			return "", tokens, fmt.Errorf("MathML to OMML conversion failed: %w", errConv)
+			return "", fmt.Errorf("%w: MathML to OMML: %w", ErrConversion, errConv)
 		}
-		resultText = omml
+		return omml, nil
 	default:
-		return "", tokens, fmt.Errorf("invalid format: %s. Supported formats are latex, mathml, omml", outputFormat)
+		return "", fmt.Errorf("%w: invalid format: %s. Supported formats are latex, mathml, omml", ErrConversion, outputFormat)
 	}
+}
 
-	return resultText, tokens, nil
+// newInterruptibleVM returns a goja runtime that is interrupted with
+// ctx.Err() once ctx is done. Call stop when the runtime is no longer used.
+func newInterruptibleVM(ctx context.Context) (vm *goja.Runtime, stop func() bool) {
+	vm = goja.New()
+	stop = context.AfterFunc(ctx, func() {
+		vm.Interrupt(ctx.Err())
+	})
+	return vm, stop
 }
 
-func convertLatexToMathML(latex string) (string, error) {
-	if len(katexJSCode) == 0 {
+func (e *Engine) convertLatexToMathML(ctx context.Context, latex string) (string, error) {
+	if len(e.katexJS) == 0 {
 		return "", fmt.Errorf("KaTeX JavaScript code has not been initialized or is empty")
 	}
-	vm := goja.New()
-	_, err := vm.RunString(string(katexJSCode))
+	vm, stop := newInterruptibleVM(ctx)
+	defer stop()
+	_, err := vm.RunString(string(e.katexJS))
 	if err != nil {
 		return "", fmt.Errorf("failed to execute KaTeX JavaScript: %w", err)
 	}
@@ -183,13 +476,14 @@ func convertLatexToMathML(latex string) (string, error) {
 }
 
 // convertMathMLToOMML re-enabled with goja and mathml2omml.js
-func convertMathMLToOMML(mathml string) (string, error) {
-	if len(mathml2ommlJSCode) == 0 {
+func (e *Engine) convertMathMLToOMML(ctx context.Context, mathml string) (string, error) {
+	if len(e.mathml2ommlJS) == 0 {
 		return "", fmt.Errorf("mathml2omml.js code has not been initialized or is empty")
 	}
 
-	vm := goja.New()
-	_, err := vm.RunString(string(mathml2ommlJSCode))
+	vm, stop := newInterruptibleVM(ctx)
+	defer stop()
+	_, err := vm.RunString(string(e.mathml2ommlJS))
 	if err != nil {
 		return "", fmt.Errorf("failed to execute mathml2omml.js: %w", err)
 	}
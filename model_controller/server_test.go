@@ -0,0 +1,50 @@
+package model_controller
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreprocessImage(t *testing.T) {
+	e := &Engine{preprocessor: fixtureSizePreprocessor(t, PreprocessOptions{})}
+	fixture, err := os.ReadFile(filepath.Join("testdata", "transparent_glyph.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"png", fixture, nil},
+		{"garbage", []byte("definitely not an image"), ErrImageDecode},
+		{"empty", nil, ErrImageDecode},
+		{"truncated png", fixture[:len(fixture)/2], ErrImageDecode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := e.preprocessImage(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("preprocessImage error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && img == nil {
+				t.Fatal("preprocessImage returned no image")
+			}
+		})
+	}
+}
+
+func TestFormatLatex(t *testing.T) {
+	e := &Engine{}
+	got, err := e.formatLatex(context.Background(), `\frac{a}{b}`, "latex")
+	if err != nil || got != `\frac{a}{b}` {
+		t.Errorf("formatLatex(latex) = %q, %v", got, err)
+	}
+	// 不支持的格式同样以 ErrConversion 报告
+	if _, err := e.formatLatex(context.Background(), "x", "pdf"); !errors.Is(err, ErrConversion) {
+		t.Errorf("formatLatex(pdf) error = %v, want ErrConversion", err)
+	}
+}
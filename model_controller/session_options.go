@@ -0,0 +1,110 @@
+package model_controller
+
+import (
+	"fmt"
+
+	onnxruntime "github.com/yalue/onnxruntime_go"
+)
+
+// 图优化级别的取值，对应 onnxruntime 的 GraphOptimizationLevel
+var graphOptimizationLevels = map[string]onnxruntime.GraphOptimizationLevel{
+	"disable_all": onnxruntime.GraphOptimizationLevelDisableAll,
+	"basic":       onnxruntime.GraphOptimizationLevelEnableBasic,
+	"extended":    onnxruntime.GraphOptimizationLevelEnableExtended,
+	"all":         onnxruntime.GraphOptimizationLevelEnableAll,
+}
+
+// SessionOptions 是创建 encoder/decoder session 时使用的 onnxruntime 配置。
+// onnxruntime_go v1.19.0 没有封装 SetOptimizedModelFilePath，也没有对应的 session 配置项，
+// 因此暂不支持把优化后的模型缓存到磁盘。
+type SessionOptions struct {
+	UseCoreML bool
+	UseCUDA   bool
+
+	// 每个 session 的线程数，0 表示使用 onnxruntime 的默认值
+	IntraOpThreads int
+	InterOpThreads int
+
+	// GraphOptimizationLevel 为 "disable_all"、"basic"、"extended" 或 "all"，空字符串表示默认值（all）
+	GraphOptimizationLevel string
+	// 关闭 CPU 内存池（arena）与内存复用模式（mem pattern），两者默认开启
+	DisableCPUMemArena bool
+	DisableMemPattern  bool
+}
+
+// Validate 检查配置是否有效
+func (o SessionOptions) Validate() error {
+	if o.IntraOpThreads < 0 || o.InterOpThreads < 0 {
+		return fmt.Errorf("invalid thread counts %d/%d", o.IntraOpThreads, o.InterOpThreads)
+	}
+	if o.GraphOptimizationLevel != "" {
+		if _, ok := graphOptimizationLevels[o.GraphOptimizationLevel]; !ok {
+			return fmt.Errorf("invalid graph optimization level %q, want disable_all, basic, extended or all", o.GraphOptimizationLevel)
+		}
+	}
+	return nil
+}
+
+// newSessionOptions 创建对应的 onnxruntime.SessionOptions，调用方负责 Destroy
+func (o SessionOptions) newSessionOptions() (*onnxruntime.SessionOptions, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	options, err := onnxruntime.NewSessionOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	if o.GraphOptimizationLevel != "" {
+		if err := options.SetGraphOptimizationLevel(graphOptimizationLevels[o.GraphOptimizationLevel]); err != nil {
+			options.Destroy()
+			return nil, err
+		}
+	}
+	if o.DisableCPUMemArena {
+		if err := options.SetCpuMemArena(false); err != nil {
+			options.Destroy()
+			return nil, err
+		}
+	}
+	if o.DisableMemPattern {
+		if err := options.SetMemPattern(false); err != nil {
+			options.Destroy()
+			return nil, err
+		}
+	}
+
+	if o.IntraOpThreads > 0 {
+		if err := options.SetIntraOpNumThreads(o.IntraOpThreads); err != nil {
+			options.Destroy()
+			return nil, err
+		}
+	}
+	if o.InterOpThreads > 0 {
+		if err := options.SetInterOpNumThreads(o.InterOpThreads); err != nil {
+			options.Destroy()
+			return nil, err
+		}
+	}
+
+	if o.UseCoreML {
+		if err := options.AppendExecutionProviderCoreML(0); err != nil {
+			options.Destroy()
+			return nil, err
+		}
+	}
+
+	if o.UseCUDA {
+		cudaOptions, err := onnxruntime.NewCUDAProviderOptions()
+		if err != nil {
+			options.Destroy()
+			return nil, err
+		}
+		defer cudaOptions.Destroy()
+		if err := options.AppendExecutionProviderCUDA(cudaOptions); err != nil {
+			options.Destroy()
+			return nil, err
+		}
+	}
+	return options, nil
+}
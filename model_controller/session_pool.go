@@ -0,0 +1,146 @@
+package model_controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// sessionPair is one encoder/decoder session pair. A pair serves one
+// recognition at a time.
+type sessionPair struct {
+	encoder *Encoder
+	decoder *Decoder
+}
+
+func (p *sessionPair) close() {
+	if p.decoder != nil {
+		p.decoder.Close()
+	}
+	if p.encoder != nil {
+		p.encoder.Close()
+	}
+}
+
+// sessionPool hands out session pairs so several images can be recognized
+// in parallel.
+type sessionPool struct {
+	pairs []*sessionPair
+	idle  chan *sessionPair
+	// all is held from acquireAll to releaseAll. Without it two callers
+	// could each take part of the pool and wait for each other forever.
+	all sync.Mutex
+	// closed is closed by shutdown; acquire and acquireAll fail afterwards.
+	closed       chan struct{}
+	shutdownOnce sync.Once
+}
+
+// newSessionPool creates size session pairs from the given model data.
+func newSessionPool(size int, encoderData, decoderData []byte, decoderConfig *DecoderConfig, opts SessionOptions) (*sessionPool, error) {
+	if size < 1 {
+		size = 1
+	}
+	p := &sessionPool{idle: make(chan *sessionPair, size), closed: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		pair := &sessionPair{}
+		var err error
+		pair.encoder, err = NewEncoder(encoderData, opts)
+		if err != nil {
+			p.closeAll()
+			return nil, fmt.Errorf("failed to initialize encoder: %w", err)
+		}
+		pair.decoder, err = NewDecoder(decoderData, decoderConfig, opts)
+		if err != nil {
+			pair.close()
+			p.closeAll()
+			return nil, fmt.Errorf("failed to initialize decoder: %w", err)
+		}
+		p.pairs = append(p.pairs, pair)
+		p.idle <- pair
+	}
+	return p, nil
+}
+
+// acquire waits for an idle session pair or until ctx is done. It returns
+// ErrModelsNotLoaded once the pool has been shut down.
+func (p *sessionPool) acquire(ctx context.Context) (*sessionPair, error) {
+	select {
+	case pair := <-p.idle:
+		if p.isClosed() {
+			p.idle <- pair
+			return nil, ErrModelsNotLoaded
+		}
+		return pair, nil
+	case <-p.closed:
+		return nil, ErrModelsNotLoaded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release returns a pair obtained from acquire.
+func (p *sessionPool) release(pair *sessionPair) {
+	p.idle <- pair
+}
+
+// acquireAll waits until every pair is idle and takes them all, so that the
+// decoders can be reconfigured. Only one caller holds all pairs at a time;
+// the pairs must be returned with releaseAll. It returns
+// ErrModelsNotLoaded once the pool has been shut down.
+func (p *sessionPool) acquireAll() ([]*sessionPair, error) {
+	p.all.Lock()
+	pairs := make([]*sessionPair, 0, len(p.pairs))
+	for len(pairs) < len(p.pairs) {
+		select {
+		case pair := <-p.idle:
+			pairs = append(pairs, pair)
+		case <-p.closed:
+		}
+		if p.isClosed() {
+			p.releaseAll(pairs)
+			return nil, ErrModelsNotLoaded
+		}
+	}
+	return pairs, nil
+}
+
+// releaseAll returns the pairs taken by acquireAll.
+func (p *sessionPool) releaseAll(pairs []*sessionPair) {
+	for _, pair := range pairs {
+		p.idle <- pair
+	}
+	p.all.Unlock()
+}
+
+// shutdown makes acquire and acquireAll fail from now on, including calls
+// already waiting for a pair. Pairs in use stay valid until released.
+func (p *sessionPool) shutdown() {
+	p.shutdownOnce.Do(func() { close(p.closed) })
+}
+
+func (p *sessionPool) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close shuts the pool down, waits for running recognitions to return
+// their pairs and destroys every session. It must be called only once.
+func (p *sessionPool) close() {
+	p.shutdown()
+	// acquireAll gives back what it holds once shut down, so every pair
+	// returns to idle without taking p.all.
+	for range p.pairs {
+		<-p.idle
+	}
+	p.closeAll()
+}
+
+func (p *sessionPool) closeAll() {
+	for _, pair := range p.pairs {
+		pair.close()
+	}
+}
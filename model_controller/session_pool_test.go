@@ -0,0 +1,137 @@
+package model_controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPool 创建不含 ONNX 会话的会话池，只用于测试获取与归还的逻辑
+func newTestPool(size int) *sessionPool {
+	p := &sessionPool{idle: make(chan *sessionPair, size), closed: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		pair := &sessionPair{}
+		p.pairs = append(p.pairs, pair)
+		p.idle <- pair
+	}
+	return p
+}
+
+// 两个并发的 acquireAll 不能各自拿走部分会话后互相等待
+func TestSessionPoolConcurrentAcquireAll(t *testing.T) {
+	p := newTestPool(3)
+	var busy []*sessionPair
+	for i := 0; i < 2; i++ {
+		pair, err := p.acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		busy = append(busy, pair)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pairs, err := p.acquireAll()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			p.releaseAll(pairs)
+		}()
+	}
+	// 让两个 acquireAll 都先拿到唯一空闲的会话（或等待锁）
+	time.Sleep(10 * time.Millisecond)
+	for _, pair := range busy {
+		p.release(pair)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("concurrent acquireAll calls deadlocked")
+	}
+	if len(p.idle) != 3 {
+		t.Errorf("%d idle pairs after releaseAll, want 3", len(p.idle))
+	}
+}
+
+// 关闭后的引擎，配置与状态查询应返回 ErrModelsNotLoaded 而不是 panic 或阻塞
+func TestClosedEngineReportsModelsNotLoaded(t *testing.T) {
+	e := &Engine{pool: newTestPool(2)}
+	e.Close()
+	e.Close()
+	if _, err := e.Status(); !errors.Is(err, ErrModelsNotLoaded) {
+		t.Errorf("Status() error = %v, want ErrModelsNotLoaded", err)
+	}
+	if err := e.SetBeamSearch(4, 1, true); !errors.Is(err, ErrModelsNotLoaded) {
+		t.Errorf("SetBeamSearch() error = %v, want ErrModelsNotLoaded", err)
+	}
+	if err := e.SetGrammarConstraint(true); !errors.Is(err, ErrModelsNotLoaded) {
+		t.Errorf("SetGrammarConstraint() error = %v, want ErrModelsNotLoaded", err)
+	}
+	if err := e.SetLoopDetection(6); !errors.Is(err, ErrModelsNotLoaded) {
+		t.Errorf("SetLoopDetection() error = %v, want ErrModelsNotLoaded", err)
+	}
+	if err := e.checkLoaded(); !errors.Is(err, ErrModelsNotLoaded) {
+		t.Errorf("checkLoaded() error = %v, want ErrModelsNotLoaded", err)
+	}
+}
+
+// Close 等待正在使用的会话归还；等待中的 acquire 与 acquireAll 立即失败
+func TestSessionPoolCloseWhileInUse(t *testing.T) {
+	p := newTestPool(1)
+	pair, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waiting := make(chan error, 2)
+	go func() {
+		_, err := p.acquire(context.Background())
+		waiting <- err
+	}()
+	go func() {
+		_, err := p.acquireAll()
+		waiting <- err
+	}()
+	closed := make(chan struct{})
+	go func() {
+		p.close()
+		close(closed)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-waiting:
+			if !errors.Is(err, ErrModelsNotLoaded) {
+				t.Errorf("waiting acquire error = %v, want ErrModelsNotLoaded", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("waiting acquire did not fail after close")
+		}
+	}
+	select {
+	case <-closed:
+		t.Fatal("close returned while a pair was still in use")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.release(pair)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("close did not return after the pair was released")
+	}
+	if _, err := p.acquire(context.Background()); !errors.Is(err, ErrModelsNotLoaded) {
+		t.Errorf("acquire after close error = %v, want ErrModelsNotLoaded", err)
+	}
+}
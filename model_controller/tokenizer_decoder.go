@@ -8,8 +8,9 @@ type Tokenizer struct {
 	tok *tokenizers.Tokenizer
 }
 
-func NewTokenizer(path string) (*Tokenizer, error) {
-	tk, err := tokenizers.FromFile(path)
+// NewTokenizer 从 tokenizer.json 的内容创建 Tokenizer
+func NewTokenizer(data []byte) (*Tokenizer, error) {
+	tk, err := tokenizers.FromBytes(data)
 	if err != nil {
 		return nil, err
 	}